@@ -0,0 +1,102 @@
+package mydb
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"fmt"
+)
+
+// May read keys.
+const PERM_READ = uint8(0x01)
+
+// May write and delete keys.
+const PERM_WRITE = uint8(0x02)
+
+// May write keys on a read-only replica. Meant for the user the
+// master replicates as.
+const PERM_REPLICATE = uint8(0x04)
+
+// Grants permissions on all keys starting with Prefix. An empty
+// prefix matches every key.
+type Grant struct {
+	Prefix []byte
+	Perms uint8
+}
+
+type User struct {
+	Name string
+	Token string
+	Grants []Grant
+}
+
+// Whether the user has all permissions in perms on key.
+func (u *User) Allowed(key []byte, perms uint8) bool {
+	granted := uint8(0)
+
+	for _, grant := range u.Grants {
+		if bytes.HasPrefix(key, grant.Prefix) {
+			granted |= grant.Perms
+		}
+	}
+
+	return granted & perms == perms
+}
+
+// The users allowed to connect to an engine. Clients authenticate
+// with a name and a token sent in an Auth message, so use TLS if the
+// network can't be trusted.
+type ACL struct {
+	users map[string]*User
+}
+
+func NewACL(users ...*User) *ACL {
+	acl := &ACL{
+		users: make(map[string]*User),
+	}
+
+	for _, user := range users {
+		acl.users[user.Name] = user
+	}
+
+	return acl
+}
+
+// Returns the user if name and token match, nil otherwise.
+func (acl *ACL) Authenticate(name []byte, token []byte) *User {
+	user, ok := acl.users[string(name)]
+
+	if !ok {
+		return nil
+	}
+
+	if subtle.ConstantTimeCompare([]byte(user.Token), token) != 1 {
+		return nil
+	}
+
+	return user
+}
+
+// Sends the credentials over a fresh connection.
+func authenticate(ctx context.Context, pipe *pipeline, user string, token string) error {
+	msg, err := pipe.roundTripContext(ctx, &Auth{
+		User: []byte(user),
+		Token: []byte(token),
+	})
+
+	if err != nil {
+		return err
+	}
+
+	code, ok := statusCode(msg)
+
+	if !ok {
+		return fmt.Errorf("Server responded with wrong message type.")
+	}
+
+	if code != 0 {
+		return fmt.Errorf("Authentication failed (%d).", code)
+	}
+
+	return nil
+}
@@ -0,0 +1,296 @@
+package mydb_test
+
+import (
+	. "github.com/FMNSSun/mydb"
+	"net"
+	"testing"
+	"time"
+)
+
+func testACL() *ACL {
+	return NewACL(
+		&User{Name: "alice", Token: "secret", Grants: []Grant{
+			{Prefix: []byte("public/"), Perms: PERM_READ},
+			{Prefix: []byte("alice/"), Perms: PERM_READ | PERM_WRITE},
+		}},
+		&User{Name: "master", Token: "secret", Grants: []Grant{
+			{Prefix: []byte{}, Perms: PERM_READ | PERM_REPLICATE},
+		}},
+	)
+}
+
+// Connects with all capabilities and authenticates unless user is
+// empty.
+func dialAs(t *testing.T, addr string, user string, token string) MessageConn {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+
+	if err != nil {
+		t.Fatalf("dial: %s", err.Error())
+	}
+
+	mconn := NewMessageConn(conn)
+
+	if requestCode(t, mconn, &Hello{MId: 1, Version: PROTOCOL_VERSION, Caps: CAPS_SUPPORTED}) != 0 {
+		t.Fatalf("hello failed")
+	}
+
+	if user != "" {
+		code := requestCode(t, mconn, &Auth{MId: 2, User: []byte(user), Token: []byte(token)})
+
+		if code != 0 {
+			t.Fatalf("auth as %s failed with %d", user, code)
+		}
+	}
+
+	return mconn
+}
+
+// Sends msg and returns the error code of the answer, zero if it
+// isn't an error.
+func requestCode(t *testing.T, mconn MessageConn, msg Message) uint8 {
+	t.Helper()
+
+	err := mconn.SendMessage(msg)
+
+	if err != nil {
+		t.Fatalf("send: %s", err.Error())
+	}
+
+	retMsg, err := mconn.ReadMessage()
+
+	if err != nil {
+		t.Fatalf("read: %s", err.Error())
+	}
+
+	switch retMsg.(type) {
+	case *Status:
+		return retMsg.(*Status).StatusCode
+	case *Error:
+		return retMsg.(*Error).Code
+	case *MResult:
+		for _, status := range retMsg.(*MResult).Statuses {
+			if status != 0 {
+				return status
+			}
+		}
+	}
+
+	return 0
+}
+
+func TestACLPrefixes(t *testing.T) {
+	engine, s := newTestEngine(&EngineConfig{ACL: testACL()})
+	defer engine.Close()
+
+	addr := serve(t, engine, nil)
+
+	s.Put([]byte("public/a"), []byte("value"))
+	s.Put([]byte("secret/a"), []byte("value"))
+
+	mconn := dialAs(t, addr, "alice", "secret")
+	defer mconn.Close()
+
+	cases := []struct {
+		msg Message
+		code uint8
+	}{
+		{&Get{MId: 3, Key: []byte("public/a")}, 0},
+		{&Get{MId: 4, Key: []byte("secret/a")}, ERR_DENIED},
+		{&Scan{MId: 5, Prefix: []byte("secret/"), Limit: 10}, ERR_DENIED},
+		{&Put{MId: 6, Key: []byte("public/a"), Value: []byte("changed")}, ERR_DENIED},
+		{&Delete{MId: 7, Key: []byte("public/a")}, ERR_DENIED},
+		{&Put{MId: 8, Key: []byte("alice/a"), Value: []byte("value")}, 0},
+		{&Delete{MId: 9, Key: []byte("alice/a")}, 0},
+	}
+
+	for _, c := range cases {
+		code := requestCode(t, mconn, c.msg)
+
+		if code != c.code {
+			t.Errorf("%s: expected %d, got %d", c.msg, c.code, code)
+		}
+	}
+
+	value, _ := s.Get([]byte("public/a"))
+
+	if string(value) != "value" {
+		t.Fatalf("denied write changed public/a to %q", value)
+	}
+}
+
+func TestACLBatches(t *testing.T) {
+	engine, s := newTestEngine(&EngineConfig{ACL: testACL()})
+	defer engine.Close()
+
+	addr := serve(t, engine, nil)
+
+	mconn := dialAs(t, addr, "alice", "secret")
+	defer mconn.Close()
+
+	code := requestCode(t, mconn, &MGet{MId: 3, Keys: [][]byte{[]byte("public/a"), []byte("secret/a")}})
+
+	if code != ERR_DENIED {
+		t.Fatalf("mget with a denied key: expected %d, got %d", ERR_DENIED, code)
+	}
+
+	code = requestCode(t, mconn, &MPut{MId: 4,
+		Keys: [][]byte{[]byte("alice/a"), []byte("public/a")},
+		Values: [][]byte{[]byte("value"), []byte("value")},
+	})
+
+	if code != ERR_DENIED {
+		t.Fatalf("mput with a denied key: expected %d, got %d", ERR_DENIED, code)
+	}
+
+	value, _ := s.Get([]byte("alice/a"))
+
+	if value != nil {
+		t.Fatalf("allowed part of a denied batch was written")
+	}
+
+	code = requestCode(t, mconn, &MPut{MId: 5,
+		Keys: [][]byte{[]byte("alice/a"), []byte("alice/b")},
+		Values: [][]byte{[]byte("value"), []byte("value")},
+	})
+
+	if code != 0 {
+		t.Fatalf("mput with allowed keys failed with %d", code)
+	}
+}
+
+func TestACLUnauthenticated(t *testing.T) {
+	engine, _ := newTestEngine(&EngineConfig{ACL: testACL()})
+	defer engine.Close()
+
+	addr := serve(t, engine, nil)
+
+	mconn := dialAs(t, addr, "", "")
+	defer mconn.Close()
+
+	if code := requestCode(t, mconn, &Limits{MId: 3}); code != 0 {
+		t.Fatalf("limits: expected them without authentication, got %d", code)
+	}
+
+	if code := requestCode(t, mconn, &Get{MId: 4, Key: []byte("public/a")}); code != ERR_AUTH {
+		t.Fatalf("get: expected %d, got %d", ERR_AUTH, code)
+	}
+
+	if code := requestCode(t, mconn, &Put{MId: 5, Key: []byte("alice/a"), Value: []byte("value")}); code != ERR_AUTH {
+		t.Fatalf("put: expected %d, got %d", ERR_AUTH, code)
+	}
+}
+
+func TestACLFailedAuthClosesConnection(t *testing.T) {
+	engine, _ := newTestEngine(&EngineConfig{ACL: testACL()})
+	defer engine.Close()
+
+	addr := serve(t, engine, nil)
+
+	mconn := dialAs(t, addr, "", "")
+	defer mconn.Close()
+
+	code := requestCode(t, mconn, &Auth{MId: 3, User: []byte("alice"), Token: []byte("wrong")})
+
+	if code != ERR_AUTH {
+		t.Fatalf("auth with wrong token: expected %d, got %d", ERR_AUTH, code)
+	}
+
+	mconn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	// Writing may still succeed, the response never comes.
+	mconn.SendMessage(&Auth{MId: 4, User: []byte("alice"), Token: []byte("secret")})
+
+	msg, err := mconn.ReadMessage()
+
+	if err == nil {
+		t.Fatalf("connection still open after failed auth, got %s", msg)
+	}
+}
+
+func TestACLReplicate(t *testing.T) {
+	replica, s := newTestEngine(&EngineConfig{Role: ROLE_REPLICA, ACL: testACL()})
+	defer replica.Close()
+
+	addr := serve(t, replica, nil)
+
+	s.Put([]byte("alice/a"), []byte("value"))
+
+	rput := &RPut{
+		Keys: [][]byte{[]byte("alice/b")},
+		Values: [][]byte{[]byte("value")},
+		Versions: []uint64{1},
+		Expires: []time.Time{time.Time{}},
+	}
+
+	alice := dialAs(t, addr, "alice", "secret")
+	defer alice.Close()
+
+	for _, msg := range []Message{
+		&Put{MId: 3, Key: []byte("alice/b"), Value: []byte("value")},
+		&RPut{MId: 4, Keys: rput.Keys, Values: rput.Values, Versions: rput.Versions, Expires: rput.Expires},
+		&Snapshot{MId: 5, Phase: SNAPSHOT_BEGIN},
+		&Snapshot{MId: 6, Phase: SNAPSHOT_END},
+	} {
+		code := requestCode(t, alice, msg)
+
+		if code != ERR_READONLY {
+			t.Errorf("%s without PERM_REPLICATE: expected %d, got %d", msg, ERR_READONLY, code)
+		}
+	}
+
+	value, _ := s.Get([]byte("alice/a"))
+
+	if value == nil {
+		t.Fatalf("snapshot without PERM_REPLICATE deleted alice/a")
+	}
+
+	master := dialAs(t, addr, "master", "secret")
+	defer master.Close()
+
+	for _, msg := range []Message{
+		&Snapshot{MId: 3, Phase: SNAPSHOT_BEGIN},
+		&RPut{MId: 4, Keys: rput.Keys, Values: rput.Values, Versions: rput.Versions, Expires: rput.Expires},
+		&Snapshot{MId: 5, Phase: SNAPSHOT_END},
+	} {
+		code := requestCode(t, master, msg)
+
+		if code != 0 {
+			t.Errorf("%s with PERM_REPLICATE failed with %d", msg, code)
+		}
+	}
+
+	value, _ = s.Get([]byte("alice/b"))
+
+	if value == nil {
+		t.Fatalf("rput with PERM_REPLICATE wasn't applied")
+	}
+}
+
+func TestACLReplicateOnMaster(t *testing.T) {
+	engine, _ := newTestEngine(&EngineConfig{ACL: testACL()})
+	defer engine.Close()
+
+	addr := serve(t, engine, nil)
+
+	mconn := dialAs(t, addr, "alice", "secret")
+	defer mconn.Close()
+
+	code := requestCode(t, mconn, &RPut{MId: 3,
+		Keys: [][]byte{[]byte("alice/a")},
+		Values: [][]byte{[]byte("value")},
+		Versions: []uint64{1},
+		Expires: []time.Time{time.Time{}},
+	})
+
+	if code != ERR_DENIED {
+		t.Fatalf("rput with PERM_WRITE only: expected %d, got %d", ERR_DENIED, code)
+	}
+
+	code = requestCode(t, mconn, &Snapshot{MId: 4, Phase: SNAPSHOT_BEGIN})
+
+	if code != ERR_DENIED {
+		t.Fatalf("snapshot with PERM_WRITE only: expected %d, got %d", ERR_DENIED, code)
+	}
+}
@@ -0,0 +1,172 @@
+package mydb
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// Result for one key of GetMany or PutMany.
+type BatchResult struct {
+	// The value GetMany found.
+	Value []byte
+	// Whether GetMany found the key.
+	Found bool
+	// Why the key couldn't be read or written.
+	Err ClientError
+}
+
+func (c *Client) GetMany(keys [][]byte) ([]BatchResult, ClientError) {
+	return c.GetManyContext(context.Background(), keys)
+}
+
+// Like GetMany but gives up once ctx is done.
+func (c *Client) GetManyContext(ctx context.Context, keys [][]byte) ([]BatchResult, ClientError) {
+	return c.batch(ctx, keys, nil)
+}
+
+// Puts values[i] under keys[i] for all i.
+func (c *Client) PutMany(keys [][]byte, values [][]byte) ([]BatchResult, ClientError) {
+	return c.PutManyContext(context.Background(), keys, values)
+}
+
+// Like PutMany but gives up once ctx is done. Some of the entries
+// may or may not have been written then.
+func (c *Client) PutManyContext(ctx context.Context, keys [][]byte, values [][]byte) ([]BatchResult, ClientError) {
+	if len(keys) != len(values) {
+		return nil, ClientErrorf("%d keys but %d values.", len(keys), len(values))
+	}
+
+	return c.batch(ctx, keys, values)
+}
+
+// Splits the keys into messages of about BatchSize bytes and sends
+// them concurrently. Gets if values is nil, puts otherwise. Returns
+// the first error that failed a whole message, the results of its
+// keys carry it as well.
+func (c *Client) batch(ctx context.Context, keys [][]byte, values [][]byte) ([]BatchResult, ClientError) {
+	results := make([]BatchResult, len(keys))
+
+	var wg sync.WaitGroup
+	var firstErr ClientError = nil
+	var errMutex sync.Mutex
+
+	window := make(chan struct{}, c.config.MaxConns)
+
+	for start := 0; start < len(keys); {
+		end := start
+		size := 0
+
+		for end < len(keys) && (end == start || size < c.config.BatchSize) {
+			size += len(keys[end]) + 2
+
+			if values != nil {
+				size += len(values[end]) + 4
+			}
+
+			end++
+		}
+
+		window <- struct{}{}
+		wg.Add(1)
+
+		go func(start int, end int) {
+			defer wg.Done()
+
+			err := c.batchPart(ctx, keys[start:end], values, start, results[start:end])
+
+			if err != nil {
+				for i := start; i < end; i++ {
+					results[i].Err = err
+				}
+
+				errMutex.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				errMutex.Unlock()
+			}
+
+			<-window
+		}(start, end)
+
+		start = end
+	}
+
+	wg.Wait()
+
+	return results, firstErr
+}
+
+// Sends keys (and values[offset:offset+len(keys)] if not nil) as
+// one message and fills in results.
+func (c *Client) batchPart(ctx context.Context, keys [][]byte, values [][]byte, offset int, results []BatchResult) ClientError {
+	var msg Message
+	var err error
+
+	if values == nil {
+		msg, err = c.read(ctx, &MGet{Keys: keys})
+	} else {
+		msg, err = c.write(ctx, &MPut{Keys: keys, Values: values[offset:offset + len(keys)]})
+	}
+
+	if err == ErrUnsupported {
+		c.batchFallback(ctx, keys, values, offset, results)
+		return nil
+	}
+
+	if err != nil {
+		log.Printf("[CLIENT] ERROR: %s", err.Error())
+		return requestError(err)
+	}
+
+	switch msg.(type) {
+	case *MResult:
+		resultMsg := msg.(*MResult)
+
+		if len(resultMsg.Statuses) != len(keys) {
+			return ClientErrorf("Server responded with %d results for %d keys.", len(resultMsg.Statuses), len(keys))
+		}
+
+		for i, status := range resultMsg.Statuses {
+			switch status {
+			case 0:
+				results[i].Found = values == nil
+				results[i].Value = resultMsg.Values[i]
+			case ERR_NOTEXISTS:
+			default:
+				results[i].Err = &clientError{
+					msg: fmt.Sprintf("Server responded with error %d", status),
+					serverCode: status,
+				}
+			}
+		}
+
+		return nil
+	case *Status, *Error:
+		return serverError(msg)
+	case *Redirect:
+		return statusResponse(msg)
+	default:
+		return ClientErrorf("Server responded with wrong message type.")
+	}
+}
+
+// One key at a time for servers that don't know batches.
+func (c *Client) batchFallback(ctx context.Context, keys [][]byte, values [][]byte, offset int, results []BatchResult) {
+	for i, key := range keys {
+		if values == nil {
+			value, err := c.GetContext(ctx, key)
+
+			if err != nil && err.ServerCode() != ERR_NOTEXISTS {
+				results[i].Err = err
+			} else if err == nil {
+				results[i].Found = true
+				results[i].Value = value
+			}
+		} else {
+			results[i].Err = c.PutContext(ctx, key, values[offset + i])
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package mydb
+
+import (
+	"bytes"
+	"sync"
+	"time"
+)
+
+// Holds results of remote lookups for peers added with LKUPMODE_CACHE.
+type lookupCache struct {
+	m map[KeyHash][]*cacheEntry
+	ttl time.Duration
+	lastPrune time.Time
+	mutex *sync.Mutex
+}
+
+type cacheEntry struct {
+	key []byte
+	value []byte
+	expires time.Time
+}
+
+func newLookupCache(ttl time.Duration) *lookupCache {
+	return &lookupCache{
+		m: make(map[KeyHash][]*cacheEntry),
+		ttl: ttl,
+		lastPrune: time.Now(),
+		mutex: &sync.Mutex{},
+	}
+}
+
+func (lc *lookupCache) get(key []byte) []byte {
+	lc.mutex.Lock()
+	defer lc.mutex.Unlock()
+
+	for _, candidate := range lc.m[Hash(key)] {
+		if bytes.Equal(candidate.key, key) {
+			if time.Now().After(candidate.expires) {
+				lc.removeLocked(key)
+				return nil
+			}
+
+			return candidate.value
+		}
+	}
+
+	return nil
+}
+
+func (lc *lookupCache) put(key []byte, value []byte) {
+	lc.mutex.Lock()
+	defer lc.mutex.Unlock()
+
+	now := time.Now()
+
+	if now.Sub(lc.lastPrune) > lc.ttl {
+		lc.pruneLocked(now)
+	}
+
+	lc.removeLocked(key)
+
+	hash := Hash(key)
+	lc.m[hash] = append(lc.m[hash], &cacheEntry{
+		key: key,
+		value: value,
+		expires: now.Add(lc.ttl),
+	})
+}
+
+func (lc *lookupCache) remove(key []byte) {
+	lc.mutex.Lock()
+	defer lc.mutex.Unlock()
+
+	lc.removeLocked(key)
+}
+
+func (lc *lookupCache) removeLocked(key []byte) {
+	hash := Hash(key)
+	entries := lc.m[hash]
+
+	for i, candidate := range entries {
+		if bytes.Equal(candidate.key, key) {
+			entries = append(entries[:i], entries[i+1:]...)
+			break
+		}
+	}
+
+	if len(entries) == 0 {
+		delete(lc.m, hash)
+	} else {
+		lc.m[hash] = entries
+	}
+}
+
+// Drops all expired entries so keys that are never asked for again
+// don't stay around forever.
+func (lc *lookupCache) pruneLocked(now time.Time) {
+	for hash, entries := range lc.m {
+		live := entries[:0]
+
+		for _, entry := range entries {
+			if now.Before(entry.expires) {
+				live = append(live, entry)
+			}
+		}
+
+		if len(live) == 0 {
+			delete(lc.m, hash)
+		} else {
+			lc.m[hash] = live
+		}
+	}
+
+	lc.lastPrune = now
+}
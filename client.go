@@ -1,108 +1,787 @@
 package mydb
 
 import (
+	"context"
+	"crypto/tls"
+	"fmt"
 	"log"
+	"math"
+	"net"
+	"strconv"
+	"sync"
+	"time"
 )
 
+// Client for a mydb server. A Client is safe for concurrent use. It
+// keeps a pool of connections to the server, every request takes
+// one for itself if it can and shares the least busy one otherwise.
+// Writes a read-only replica redirects are sent to its master over
+// a separate connection.
+//
+// If backup endpoints are configured the client connects to the
+// first endpoint that is up. Reads that fail because the connection
+// broke are retried on the next endpoint that is up, writes are not.
 type Client struct {
-	mconn MessageConn
+	config ClientConfig
+	// The primary first, then the backups.
+	endpoints []string
+	done chan struct{}
+	closeOnce *sync.Once
+
+	// Guard the fields below.
+	mutex *sync.Mutex
+	pool *connPool
+	// Index into endpoints of the server pool is connected to.
+	current int
+	master *pipeline
+	masterAddr string
+	// Closed once the connect in progress is done, nil if none is.
+	reconnecting chan struct{}
+	// Why the last connect failed.
+	reconnectErr error
+}
+
+type ClientConfig struct {
+	// If set, connect over TLS. For mutual TLS put the client
+	// certificate into TLS.Certificates.
+	TLS *tls.Config
+
+	// Credentials for servers that require authentication. Not
+	// sent if User is empty.
+	User string
+	Token string
+
+	// Servers to fail over to, in order, if the primary passed to
+	// NewClientWithConfig is down.
+	Endpoints []string
+
+	// If set, how often to check whether the primary is back while
+	// running on a backup. Zero means stay on the backup until it
+	// fails too.
+	FailBack time.Duration
+
+	// Connections kept open to the server and the most that are
+	// opened for concurrent requests.
+	MinConns int
+	MaxConns int
+
+	// Connections beyond MinConns unused for this long are closed.
+	IdleTimeout time.Duration
+
+	// How often idle connections are checked and broken and idle
+	// ones are cleaned up. A connection that doesn't answer a check
+	// within the interval is dropped.
+	HealthCheckInterval time.Duration
+
+	// GetMany and PutMany split their keys into messages of about
+	// this many bytes.
+	BatchSize int
+
+	// How many entries a Scan asks for at a time.
+	ScanPageSize int
 }
 
+const DEFAULT_CLIENT_MIN_CONNS = 1
+const DEFAULT_CLIENT_MAX_CONNS = 8
+const DEFAULT_CLIENT_IDLE_TIMEOUT = 60 * time.Second
+const DEFAULT_CLIENT_HEALTH_CHECK_INTERVAL = 5 * time.Second
+const DEFAULT_CLIENT_BATCH_SIZE = 1024 * 1024
+const DEFAULT_CLIENT_SCAN_PAGE_SIZE = 1000
+
 func NewClient(raddr string) (*Client, error) {
-	mconn, err := DialMessageConn(raddr)
+	return NewClientWithConfig(raddr, &ClientConfig{})
+}
+
+// Like NewClient but connects over TLS.
+func NewClientTLS(raddr string, config *tls.Config) (*Client, error) {
+	return NewClientWithConfig(raddr, &ClientConfig{TLS: config})
+}
+
+// Creates a client. Zero values in the config are replaced by
+// their defaults.
+func NewClientWithConfig(raddr string, config *ClientConfig) (*Client, error) {
+	c := &Client{
+		config: *config,
+		endpoints: append([]string{raddr}, config.Endpoints...),
+		done: make(chan struct{}),
+		closeOnce: &sync.Once{},
+		mutex: &sync.Mutex{},
+	}
+
+	if c.config.MinConns == 0 {
+		c.config.MinConns = DEFAULT_CLIENT_MIN_CONNS
+	}
+
+	if c.config.MaxConns == 0 {
+		c.config.MaxConns = DEFAULT_CLIENT_MAX_CONNS
+	}
+
+	if c.config.MaxConns < c.config.MinConns {
+		c.config.MaxConns = c.config.MinConns
+	}
+
+	if c.config.IdleTimeout == 0 {
+		c.config.IdleTimeout = DEFAULT_CLIENT_IDLE_TIMEOUT
+	}
+
+	if c.config.HealthCheckInterval == 0 {
+		c.config.HealthCheckInterval = DEFAULT_CLIENT_HEALTH_CHECK_INTERVAL
+	}
+
+	if c.config.BatchSize == 0 {
+		c.config.BatchSize = DEFAULT_CLIENT_BATCH_SIZE
+	}
+
+	if c.config.ScanPageSize == 0 {
+		c.config.ScanPageSize = DEFAULT_CLIENT_SCAN_PAGE_SIZE
+	}
+
+	_, err := c.connPool(context.Background())
 
 	if err != nil {
 		log.Printf("ERROR: %s", err.Error())
 		return nil, err
 	}
 
-	return &Client{mconn: mconn}, nil
+	if c.config.FailBack > 0 && len(c.endpoints) > 1 {
+		go c.failBackLoop()
+	}
+
+	return c, nil
 }
 
-func (c *Client) Get(key []byte) ([]byte, ClientError) {
-	c.mconn.Begin()
-	defer c.mconn.End()
+func (c *Client) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
 
-	getMsg := &Get{
-		Key: key,
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.master != nil {
+		c.master.close()
+	}
+
+	if c.pool == nil {
+		return nil
+	}
+
+	return c.pool.close()
+}
+
+// Whether the client is not connected to its primary.
+func (c *Client) Degraded() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.current != 0 || c.pool == nil || c.pool.broken()
+}
+
+func (c *Client) dialPool(ctx context.Context, raddr string) (*connPool, error) {
+	dial := func(ctx context.Context) (*pipeline, error) {
+		return dialPipeline(ctx, raddr, c.config.TLS, c.config.User, c.config.Token)
+	}
+
+	return newConnPool(ctx, raddr, dial, c.config.MinConns, c.config.MaxConns, c.config.IdleTimeout, c.config.HealthCheckInterval)
+}
+
+// Returns the pool to send requests over, connecting to the first
+// endpoint that is up if all connections of the current pool broke.
+// Only one connect runs at a time, callers wait for it until their
+// ctx is done.
+func (c *Client) connPool(ctx context.Context) (*connPool, error) {
+	c.mutex.Lock()
+
+	if c.pool != nil && !c.pool.broken() {
+		pool := c.pool
+		c.mutex.Unlock()
+		return pool, nil
+	}
+
+	select {
+	case <-c.done:
+		c.mutex.Unlock()
+		return nil, fmt.Errorf("Client closed.")
+	default:
+	}
+
+	if c.reconnecting == nil {
+		c.reconnecting = make(chan struct{})
+		go c.reconnect(c.reconnecting)
+	}
+
+	reconnecting := c.reconnecting
+
+	c.mutex.Unlock()
+
+	select {
+	case <-reconnecting:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.done:
+		return nil, fmt.Errorf("Client closed.")
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.pool != nil && !c.pool.broken() {
+		return c.pool, nil
+	}
+
+	if c.reconnectErr != nil {
+		return nil, c.reconnectErr
 	}
 
-	err := c.mconn.SendMessage(getMsg)
+	return nil, fmt.Errorf("Not connected.")
+}
+
+// Connects to the first endpoint that is up and swaps its pool in.
+// The mutex isn't held while connecting, so a server that doesn't
+// answer doesn't hold up other requests, Degraded or Close. Closes
+// finished when done.
+func (c *Client) reconnect(finished chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		select {
+		case <-c.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	var pool *connPool
+	var err error
+
+	current := 0
+
+	for i, raddr := range c.endpoints {
+		pool, err = c.dialPool(ctx, raddr)
+
+		if err == nil {
+			current = i
+			break
+		}
+
+		log.Printf("[CLIENT] ERROR: %s: %s", raddr, err.Error())
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.reconnecting = nil
+	c.reconnectErr = err
+
+	close(finished)
 
 	if err != nil {
-		log.Printf("ERROR: %s", err.Error())
-		return nil, ClientErrorf2(err, "Network error.")
+		return
+	}
+
+	select {
+	case <-c.done:
+		pool.close()
+		c.reconnectErr = fmt.Errorf("Client closed.")
+		return
+	default:
+	}
+
+	if c.pool != nil {
+		c.pool.close()
+
+		if current != c.current {
+			log.Printf("[CLIENT] failed over to %s", c.endpoints[current])
+		}
+	}
+
+	c.pool = pool
+	c.current = current
+}
+
+// Checks whether the primary is back while on a backup and moves
+// over to it. Requests in flight on the backup fail, reads among
+// them are retried on the primary.
+func (c *Client) failBackLoop() {
+	ticker := time.NewTicker(c.config.FailBack)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+
+		if !c.Degraded() {
+			continue
+		}
+
+		pool, err := c.dialPool(context.Background(), c.endpoints[0])
+
+		if err != nil {
+			continue
+		}
+
+		c.mutex.Lock()
+
+		select {
+		case <-c.done:
+			c.mutex.Unlock()
+			pool.close()
+			return
+		default:
+		}
+
+		if c.pool != nil {
+			c.pool.close()
+		}
+
+		c.pool = pool
+		c.current = 0
+
+		c.mutex.Unlock()
+
+		log.Printf("[CLIENT] failed back to %s", c.endpoints[0])
+	}
+}
+
+// Sends a read. If the connection breaks, tries again on the next
+// endpoint that is up.
+func (c *Client) read(ctx context.Context, msg Message) (Message, error) {
+	var err error
+
+	for i := 0; i < len(c.endpoints); i++ {
+		var pool *connPool
+
+		pool, err = c.connPool(ctx)
+
+		if err != nil {
+			return nil, err
+		}
+
+		var respMsg Message
+
+		respMsg, err = c.roundTrip(ctx, pool, msg)
+
+		if err == nil {
+			return respMsg, nil
+		}
+
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		log.Printf("[CLIENT] ERROR: %s: %s", pool, err.Error())
+	}
+
+	return nil, err
+}
+
+// Sends msg over a connection of the pool and waits for the response.
+func (c *Client) roundTrip(ctx context.Context, pool *connPool, msg Message) (Message, error) {
+	pc, err := pool.acquire(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer pool.release(pc)
+
+	return pc.pipe.roundTripContext(ctx, msg)
+}
+
+// Sends a write. If the server redirects it, sends it once more
+// to the master the server named.
+func (c *Client) write(ctx context.Context, msg Message) (Message, error) {
+	pool, err := c.connPool(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	respMsg, err := c.roundTrip(ctx, pool, msg)
+
+	if err != nil {
+		return nil, err
 	}
 
-	msg, err := c.mconn.ReadMessage()
+	redirectMsg, ok := respMsg.(*Redirect)
+
+	if !ok {
+		return respMsg, nil
+	}
+
+	pipe, err := c.masterPipe(ctx, string(redirectMsg.Addr))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return pipe.roundTripContext(ctx, msg)
+}
+
+// Returns the connection to the master at raddr, connecting if
+// there is none yet. Connects without holding the mutex.
+func (c *Client) masterPipe(ctx context.Context, raddr string) (*pipeline, error) {
+	c.mutex.Lock()
+
+	if c.master != nil && c.masterAddr == raddr && !c.master.broken() {
+		pipe := c.master
+		c.mutex.Unlock()
+		return pipe, nil
+	}
+
+	c.mutex.Unlock()
+
+	pipe, err := dialPipeline(ctx, raddr, c.config.TLS, c.config.User, c.config.Token)
+
+	if err != nil {
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	select {
+	case <-c.done:
+		pipe.close()
+		return nil, fmt.Errorf("Client closed.")
+	default:
+	}
+
+	if c.master != nil && c.masterAddr == raddr && !c.master.broken() {
+		// Somebody else was faster.
+		pipe.close()
+		return c.master, nil
+	}
+
+	if c.master != nil {
+		c.master.close()
+	}
+
+	c.master = pipe
+	c.masterAddr = raddr
+
+	return pipe, nil
+}
+
+func (c *Client) Get(key []byte) ([]byte, ClientError) {
+	return c.GetContext(context.Background(), key)
+}
+
+// Like Get but gives up once ctx is done.
+func (c *Client) GetContext(ctx context.Context, key []byte) ([]byte, ClientError) {
+	value, _, err := c.GetVersionContext(ctx, key)
+	return value, err
+}
+
+// Like Get but also returns the version of the entry for use with
+// CompareAndSwap. The version is zero if the server doesn't keep
+// versions or the entry came from a lookup server.
+func (c *Client) GetVersion(key []byte) ([]byte, uint64, ClientError) {
+	return c.GetVersionContext(context.Background(), key)
+}
+
+// Like GetVersion but gives up once ctx is done.
+func (c *Client) GetVersionContext(ctx context.Context, key []byte) ([]byte, uint64, ClientError) {
+	msg, err := c.read(ctx, &Get{
+		Key: key,
+	})
 
 	if err != nil {
 		log.Printf("ERROR: %s", err.Error())
-		return nil, ClientErrorf2(err, "Network error.")
+		return nil, 0, requestError(err)
 	}
 
 	switch msg.(type) {
 	case *Result:
 		resultMsg := msg.(*Result)
 
-		if resultMsg.MId != getMsg.MId {
-			return nil, ClientErrorf("Server responded with wrong message id.")
-		}
+		return resultMsg.Data, 0, nil
+	case *VResult:
+		vresultMsg := msg.(*VResult)
 
-		return resultMsg.Data, nil
+		return vresultMsg.Data, vresultMsg.Version, nil
 	case *Status:
 		statusMsg := msg.(*Status)
 
-		if statusMsg.MId != getMsg.MId {
-			return nil, ClientErrorf("Server responded with wrong message id.")
-		}
-
 		if statusMsg.StatusCode != 0 {
-			return nil, ClientErrorf("Server responded with error %d", statusMsg.StatusCode)
+			return nil, 0, serverError(msg)
 		}
 
-		return nil, ClientErrorf("Server responded with wrong message type.")
+		return nil, 0, ClientErrorf("Server responded with wrong message type.")
+	case *Error:
+		return nil, 0, serverError(msg)
 	default:
-		return nil, ClientErrorf("Server responded with wrong message type.")
+		return nil, 0, ClientErrorf("Server responded with wrong message type.")
 	}
 }
 
 func (c *Client) Put(key, value []byte) ClientError {
-	c.mconn.Begin()
-	defer c.mconn.End()
+	return c.PutContext(context.Background(), key, value)
+}
 
-	putMsg := &Put{
+// Like Put but gives up once ctx is done. The write may or may not
+// have happened then.
+func (c *Client) PutContext(ctx context.Context, key, value []byte) ClientError {
+	msg, err := c.write(ctx, &Put{
 		Key: key,
 		Value: value,
+	})
+
+	if err != nil {
+		log.Printf("[CLIENT] ERROR: %s", err.Error())
+		return requestError(err)
+	}
+
+	return statusResponse(msg)
+}
+
+// Like Put but the entry expires after ttl, rounded to milliseconds.
+// Zero means it never does, ttl may be at most MAX_TTL.
+func (c *Client) PutTTL(key, value []byte, ttl time.Duration) ClientError {
+	return c.PutTTLContext(context.Background(), key, value, ttl)
+}
+
+// Like PutTTL but gives up once ctx is done. The write may or may
+// not have happened then.
+func (c *Client) PutTTLContext(ctx context.Context, key, value []byte, ttl time.Duration) ClientError {
+	if ttl < 0 {
+		return ClientErrorf("Negative TTL.")
+	}
+
+	if ttl > MAX_TTL {
+		return ClientErrorf("TTL too large.")
 	}
 
-	err := c.mconn.SendMessage(putMsg)
+	millis := uint64(ttl / time.Millisecond)
+
+	if millis == 0 && ttl > 0 {
+		millis = 1
+	}
+
+	msg, err := c.write(ctx, &PutTTL{
+		TTL: millis,
+		Key: key,
+		Value: value,
+	})
 
 	if err != nil {
 		log.Printf("[CLIENT] ERROR: %s", err.Error())
-		return ClientErrorf2(err, "Network error.")
+		return requestError(err)
 	}
 
-	msg, err := c.mconn.ReadMessage()
+	return statusResponse(msg)
+}
+
+func (c *Client) Delete(key []byte) ClientError {
+	return c.DeleteContext(context.Background(), key)
+}
+
+// Like Delete but gives up once ctx is done. The delete may or may
+// not have happened then.
+func (c *Client) DeleteContext(ctx context.Context, key []byte) ClientError {
+	msg, err := c.write(ctx, &Delete{
+		Key: key,
+	})
 
 	if err != nil {
 		log.Printf("[CLIENT] ERROR: %s", err.Error())
-		return ClientErrorf2(err, "Network error.")
+		return requestError(err)
 	}
 
+	return statusResponse(msg)
+}
+
+// Puts the value only if the entry is still at the given version,
+// zero meaning it must not exist yet. Returns the new version. Fails
+// with ERR_CONFLICT as the server code if somebody else wrote first.
+func (c *Client) CompareAndSwap(key []byte, value []byte, version uint64) (uint64, ClientError) {
+	return c.CompareAndSwapContext(context.Background(), key, value, version)
+}
+
+// Like CompareAndSwap but gives up once ctx is done. The write may
+// or may not have happened then.
+func (c *Client) CompareAndSwapContext(ctx context.Context, key []byte, value []byte, version uint64) (uint64, ClientError) {
+	msg, err := c.write(ctx, &CAS{
+		Version: version,
+		Key: key,
+		Value: value,
+	})
+
+	if err != nil {
+		log.Printf("[CLIENT] ERROR: %s", err.Error())
+		return 0, requestError(err)
+	}
+
+	switch msg.(type) {
+	case *VResult:
+		return msg.(*VResult).Version, nil
+	case *Status, *Error, *Redirect:
+		return 0, statusResponse(msg)
+	default:
+		return 0, ClientErrorf("Server responded with wrong message type.")
+	}
+}
+
+// Atomically adds delta to the integer stored under key and returns
+// the result. A missing entry counts as zero. Fails with ERR_NOTINTEGER
+// or ERR_OVERFLOW as the server code if the entry holds something
+// else than an integer or the result doesn't fit.
+func (c *Client) Incr(key []byte, delta int64) (int64, ClientError) {
+	return c.IncrContext(context.Background(), key, delta)
+}
+
+// Like Incr but gives up once ctx is done. The increment may or may
+// not have happened then.
+func (c *Client) IncrContext(ctx context.Context, key []byte, delta int64) (int64, ClientError) {
+	msg, err := c.write(ctx, &Incr{
+		Delta: delta,
+		Key: key,
+	})
+
+	if err != nil {
+		log.Printf("[CLIENT] ERROR: %s", err.Error())
+		return 0, requestError(err)
+	}
+
+	var data []byte
+
 	switch msg.(type) {
+	case *VResult:
+		data = msg.(*VResult).Data
+	case *Result:
+		data = msg.(*Result).Data
+	case *Status, *Error, *Redirect:
+		return 0, statusResponse(msg)
+	default:
+		return 0, ClientErrorf("Server responded with wrong message type.")
+	}
+
+	value, perr := strconv.ParseInt(string(data), 10, 64)
+
+	if perr != nil {
+		return 0, ClientErrorf2(perr, "Server responded with something else than an integer.")
+	}
+
+	return value, nil
+}
+
+// Like Incr but subtracts delta.
+func (c *Client) Decr(key []byte, delta int64) (int64, ClientError) {
+	return c.DecrContext(context.Background(), key, delta)
+}
+
+// Like Decr but gives up once ctx is done.
+func (c *Client) DecrContext(ctx context.Context, key []byte, delta int64) (int64, ClientError) {
+	if delta == math.MinInt64 {
+		return 0, ClientErrorf("Can't decrement by %d.", delta)
+	}
+
+	return c.IncrContext(ctx, key, -delta)
+}
+
+// Asks the server for the largest key, value and message it accepts.
+func (c *Client) Limits() (*Limits, ClientError) {
+	return c.LimitsContext(context.Background())
+}
+
+// Like Limits but gives up once ctx is done.
+func (c *Client) LimitsContext(ctx context.Context) (*Limits, ClientError) {
+	msg, err := c.read(ctx, &Limits{})
+
+	if err != nil {
+		log.Printf("[CLIENT] ERROR: %s", err.Error())
+		return nil, requestError(err)
+	}
+
+	switch msg.(type) {
+	case *Limits:
+		return msg.(*Limits), nil
+	case *Status, *Error:
+		return nil, serverError(msg)
+	default:
+		return nil, ClientErrorf("Server responded with wrong message type.")
+	}
+}
+
+// Wraps an error that kept a request from getting a response.
+func requestError(err error) ClientError {
+	if err == context.DeadlineExceeded {
+		return &clientError{msg: "Request timed out.", cause: err, timeout: true}
+	}
+
+	if err == context.Canceled {
+		return ClientErrorf2(err, "Request cancelled.")
+	}
+
+	if err == ErrUnsupported {
+		return ClientErrorf2(err, "Request not supported by the server.")
+	}
+
+	netErr, ok := err.(net.Error)
+
+	if ok && netErr.Timeout() {
+		return &clientError{msg: "Network timeout.", cause: err, timeout: true}
+	}
+
+	return ClientErrorf2(err, "Network error.")
+}
+
+// Turns a Status or Error the server responded with into an error
+// carrying the server's code.
+func serverError(msg Message) ClientError {
+	switch msg.(type) {
+	case *Error:
+		errorMsg := msg.(*Error)
+
+		ce := &clientError{
+			serverCode: errorMsg.Code,
+			peer: string(errorMsg.Peer),
+		}
+
+		if len(errorMsg.Peer) > 0 {
+			ce.msg = fmt.Sprintf("Server responded with error %d: %s (Peer: %s)", errorMsg.Code, errorMsg.Msg, errorMsg.Peer)
+		} else {
+			ce.msg = fmt.Sprintf("Server responded with error %d: %s", errorMsg.Code, errorMsg.Msg)
+		}
+
+		return ce
 	case *Status:
 		statusMsg := msg.(*Status)
 
-		if statusMsg.MId != putMsg.MId {
-			return ClientErrorf("Server responded with wrong message id.")
+		return &clientError{
+			msg: fmt.Sprintf("Server responded with error %d", statusMsg.StatusCode),
+			serverCode: statusMsg.StatusCode,
 		}
+	}
+
+	return ClientErrorf("Server responded with wrong message type.")
+}
+
+// Checks a response that is expected to be a Status.
+func statusResponse(msg Message) ClientError {
+	switch msg.(type) {
+	case *Status:
+		statusMsg := msg.(*Status)
 
 		if statusMsg.StatusCode != 0 {
-			return ClientErrorf("Server responded with error %d", statusMsg.StatusCode)
+			return serverError(msg)
 		}
 
 		return nil
+	case *Error:
+		return serverError(msg)
+	case *Redirect:
+		redirectMsg := msg.(*Redirect)
+
+		return ClientErrorf("Server is read-only, master is %s.", redirectMsg.Addr)
 	default:
 		return ClientErrorf("Server responded with wrong message type.")
 	}
@@ -0,0 +1,155 @@
+package mydb_test
+
+import (
+	. "github.com/FMNSSun/mydb"
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestShortDeadlineDoesntBreakSharedConn(t *testing.T) {
+	engine, _ := newTestEngine(&EngineConfig{})
+	defer engine.Close()
+
+	addr := serve(t, engine, nil)
+
+	client, err := NewClientWithConfig(addr, &ClientConfig{MinConns: 1, MaxConns: 1})
+
+	if err != nil {
+		t.Fatalf("connect: %s", err.Error())
+	}
+
+	defer client.Close()
+
+	var wg sync.WaitGroup
+
+	failed := make(chan error, 20)
+
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+
+		go func(i int) {
+			defer wg.Done()
+
+			cerr := client.Put([]byte(fmt.Sprintf("key%d", i)), []byte("value"))
+
+			if cerr != nil {
+				failed <- cerr
+			}
+		}(i)
+
+		go func() {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 500 * time.Microsecond)
+			defer cancel()
+
+			client.GetContext(ctx, []byte("key"))
+		}()
+	}
+
+	wg.Wait()
+	close(failed)
+
+	for cerr := range failed {
+		t.Errorf("put without deadline failed: %s", cerr.Error())
+	}
+}
+
+// Accepts connections on addr but never answers.
+func blackhole(t *testing.T, addr string) net.Listener {
+	l, err := net.Listen("tcp", addr)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+
+			if err != nil {
+				return
+			}
+
+			defer conn.Close()
+		}
+	}()
+
+	return l
+}
+
+func TestReconnectDoesntBlockClient(t *testing.T) {
+	engine, _ := newTestEngine(&EngineConfig{})
+
+	addr := serve(t, engine, nil)
+
+	client, err := NewClientWithConfig(addr, &ClientConfig{MinConns: 1, MaxConns: 1})
+
+	if err != nil {
+		t.Fatalf("connect: %s", err.Error())
+	}
+
+	engine.Close()
+
+	eventually(t, "connection to break", client.Degraded)
+
+	l := blackhole(t, addr)
+	defer l.Close()
+
+	// Without a deadline this one waits for the reconnect until the
+	// client is closed.
+	stuck := make(chan struct{})
+
+	go func() {
+		client.Get([]byte("key"))
+		close(stuck)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	var wg sync.WaitGroup
+
+	start := time.Now()
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 100 * time.Millisecond)
+			defer cancel()
+
+			_, cerr := client.GetContext(ctx, []byte("key"))
+
+			if cerr == nil {
+				t.Errorf("get from a server that doesn't answer succeeded")
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if time.Since(start) > time.Second {
+		t.Fatalf("requests didn't give up at their deadline")
+	}
+
+	start = time.Now()
+
+	client.Degraded()
+	client.Close()
+
+	if time.Since(start) > time.Second {
+		t.Fatalf("Degraded and Close waited for the reconnect")
+	}
+
+	select {
+	case <-stuck:
+	case <-time.After(time.Second):
+		t.Fatalf("closing the client didn't end the reconnect")
+	}
+}
@@ -30,7 +30,7 @@ func main() {
 
 	time.Sleep(2 * time.Second)
 
-	err := engine1.AddReplica("localhost:10002")
+	err := engine1.AddReplica("localhost:10002", REPLMODE_SYNC)
 
 	if err != nil {
 		log.Fatal(err.Error())
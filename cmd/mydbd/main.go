@@ -3,11 +3,537 @@ package main
 import (
 	. "github.com/FMNSSun/mydb"
 	. "github.com/FMNSSun/mydb/storage"
-	"log"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
+type config struct {
+	Listen string `json:"listen"`
+
+	// "memory", "ordered" (in memory, can be scanned) or "disk".
+	Storage string `json:"storage"`
+	Path string `json:"path"`
+
+	// "always", "interval" or "never".
+	Fsync string `json:"fsync"`
+
+	// "fatal", "error", "warning", "info" or "verbose".
+	LogLevel string `json:"log_level"`
+
+	Replicas []peerConfig `json:"replicas"`
+	Lookups []peerConfig `json:"lookups"`
+
+	// Seconds to wait for requests and replication to finish
+	// on SIGINT/SIGTERM.
+	ShutdownTimeout int `json:"shutdown_timeout"`
+
+	// Seconds a client may take to send a message or take a
+	// response, and may stay connected without a request. Zero
+	// means forever.
+	ReadTimeout int `json:"read_timeout"`
+	WriteTimeout int `json:"write_timeout"`
+	IdleTimeout int `json:"idle_timeout"`
+
+	// Largest key, value and message in bytes accepted from
+	// clients. Zero means the engine's default.
+	MaxKeySize int `json:"max_key_size"`
+	MaxValueSize int `json:"max_value_size"`
+	MaxFrameSize int `json:"max_frame_size"`
+
+	// Seconds between looking for expired entries to delete. Zero
+	// means the engine's default.
+	ExpiryInterval int `json:"expiry_interval"`
+
+	// Certificate and key enable TLS for clients and peers. The CA
+	// file verifies peers and, with client auth, client certificates.
+	TLSCert string `json:"tls_cert"`
+	TLSKey string `json:"tls_key"`
+	TLSCA string `json:"tls_ca"`
+	TLSClientAuth bool `json:"tls_client_auth"`
+
+	// If any users are configured clients have to authenticate.
+	Users []userConfig `json:"users"`
+
+	// Credentials presented to replicas and lookup servers.
+	PeerUser string `json:"peer_user"`
+	PeerToken string `json:"peer_token"`
+
+	// "master" or "replica". A replica needs users, the master's
+	// peer user with the "p" permission.
+	Role string `json:"role"`
+
+	// Where a replica redirects client writes to.
+	Master string `json:"master"`
+}
+
+type userConfig struct {
+	Name string `json:"name"`
+	Token string `json:"token"`
+	Grants []grantConfig `json:"grants"`
+}
+
+type grantConfig struct {
+	Prefix string `json:"prefix"`
+
+	// Any of "r" (read), "w" (write) and "p" (replicate onto a
+	// read-only replica), e.g. "rw".
+	Perms string `json:"perms"`
+}
+
+type peerConfig struct {
+	Addr string `json:"addr"`
+
+	// Replicas: "sync" or "async". Lookups: a comma separated
+	// list of "cache", "persist" and "parallel".
+	Mode string `json:"mode"`
+}
+
+// Collects repeated addr[=mode] flags.
+type peerFlags []peerConfig
+
+func (pf *peerFlags) String() string {
+	return fmt.Sprintf("%v", *pf)
+}
+
+func (pf *peerFlags) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+
+	pc := peerConfig{Addr: parts[0]}
+
+	if len(parts) == 2 {
+		pc.Mode = parts[1]
+	}
+
+	*pf = append(*pf, pc)
+
+	return nil
+}
+
+var logLevels = map[string]uint8{
+	"fatal": LOGLVL_FATAL,
+	"error": LOGLVL_ERROR,
+	"warning": LOGLVL_WARNING,
+	"info": LOGLVL_INFO,
+	"verbose": LOGLVL_VERBOSE,
+}
+
+var fsyncModes = map[string]uint8{
+	"always": FSYNC_ALWAYS,
+	"interval": FSYNC_INTERVAL,
+	"never": FSYNC_NEVER,
+}
+
+var replModes = map[string]uint8{
+	"": REPLMODE_SYNC,
+	"sync": REPLMODE_SYNC,
+	"async": REPLMODE_ASYNC,
+}
+
+var lkupModes = map[string]uint8{
+	"cache": LKUPMODE_CACHE,
+	"persist": LKUPMODE_PERSIST,
+	"parallel": LKUPMODE_PARALLEL,
+}
+
+func lookupMode(mode string) (uint8, error) {
+	lkupMode := LKUPMODE_DEFAULT
+
+	if mode == "" {
+		return lkupMode, nil
+	}
+
+	for _, name := range strings.Split(mode, ",") {
+		bit, ok := lkupModes[name]
+
+		if !ok {
+			return 0, fmt.Errorf("Unknown lookup mode %q.", name)
+		}
+
+		lkupMode |= bit
+	}
+
+	return lkupMode, nil
+}
+
+var permChars = map[rune]uint8{
+	'r': PERM_READ,
+	'w': PERM_WRITE,
+	'p': PERM_REPLICATE,
+}
+
+var roles = map[string]uint8{
+	"master": ROLE_MASTER,
+	"replica": ROLE_REPLICA,
+}
+
+func buildACL(users []userConfig) (*ACL, error) {
+	aclUsers := make([]*User, 0, len(users))
+
+	for _, uc := range users {
+		user := &User{Name: uc.Name, Token: uc.Token}
+
+		if uc.Name == "" || uc.Token == "" {
+			return nil, fmt.Errorf("User needs a name and a token.")
+		}
+
+		for _, gc := range uc.Grants {
+			grant := Grant{Prefix: []byte(gc.Prefix)}
+
+			for _, c := range gc.Perms {
+				perm, ok := permChars[c]
+
+				if !ok {
+					return nil, fmt.Errorf("Unknown permission %q for user %s.", c, uc.Name)
+				}
+
+				grant.Perms |= perm
+			}
+
+			user.Grants = append(user.Grants, grant)
+		}
+
+		aclUsers = append(aclUsers, user)
+	}
+
+	return NewACL(aclUsers...), nil
+}
+
+func loadConfig(path string, cfg *config) error {
+	f, err := os.Open(path)
+
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+
+	return dec.Decode(cfg)
+}
+
+// Builds the listener's and the peers' TLS configs from cfg.
+func loadTLS(cfg *config) (*tls.Config, *tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var pool *x509.CertPool = nil
+
+	if cfg.TLSCA != "" {
+		pem, err := os.ReadFile(cfg.TLSCA)
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		pool = x509.NewCertPool()
+
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, nil, fmt.Errorf("No certificates found in %s.", cfg.TLSCA)
+		}
+	}
+
+	serverConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs: pool,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if cfg.TLSClientAuth {
+		serverConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	peerConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs: pool,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	return serverConfig, peerConfig, nil
+}
+
+// Keeps trying to add a peer that may not be up yet.
+func addPeer(logger Logger, what string, raddr string, add func() error) {
+	delay := 1 * time.Second
+
+	for {
+		err := add()
+
+		if err == nil {
+			logger.Outf(LOGLVL_INFO, "[MYDBD] added %s %s", what, raddr)
+			return
+		}
+
+		if err == ErrEngineClosed {
+			return
+		}
+
+		logger.Outf(LOGLVL_ERROR, "[MYDBD] ERROR: adding %s %s: %s", what, raddr, err.Error())
+
+		time.Sleep(delay)
+
+		if delay < 30 * time.Second {
+			delay *= 2
+		}
+	}
+}
+
 func main() {
-	e := NewEngine(NewMemoryStorage())
-	err := e.Serve()
-	log.Fatal(err.Error())
+	cfg := &config{
+		Listen: ":10001",
+		Storage: "memory",
+		Fsync: "interval",
+		LogLevel: "info",
+		ShutdownTimeout: 30,
+		Role: "master",
+	}
+
+	var replicas peerFlags
+	var lookups peerFlags
+
+	configPath := flag.String("config", "", "JSON config file. Flags override its settings.")
+	listen := flag.String("listen", cfg.Listen, "Address to listen on.")
+	storageType := flag.String("storage", cfg.Storage, "Storage backend: memory, ordered or disk.")
+	path := flag.String("path", cfg.Path, "Data directory of the disk storage.")
+	fsync := flag.String("fsync", cfg.Fsync, "When the disk storage syncs: always, interval or never.")
+	logLevel := flag.String("loglevel", cfg.LogLevel, "fatal, error, warning, info or verbose.")
+	shutdownTimeout := flag.Int("shutdown-timeout", cfg.ShutdownTimeout, "Seconds to wait for a graceful shutdown.")
+	readTimeout := flag.Int("read-timeout", cfg.ReadTimeout, "Seconds a client may take to send a message.")
+	writeTimeout := flag.Int("write-timeout", cfg.WriteTimeout, "Seconds a client may take to take a response.")
+	idleTimeout := flag.Int("idle-timeout", cfg.IdleTimeout, "Seconds before an idle client connection is closed.")
+	maxKeySize := flag.Int("max-key-size", cfg.MaxKeySize, "Largest key in bytes. 0 means the default.")
+	maxValueSize := flag.Int("max-value-size", cfg.MaxValueSize, "Largest value in bytes. 0 means the default.")
+	maxFrameSize := flag.Int("max-frame-size", cfg.MaxFrameSize, "Largest message in bytes. 0 means the default.")
+	expiryInterval := flag.Int("expiry-interval", cfg.ExpiryInterval, "Seconds between deleting expired entries. 0 means the default.")
+	tlsCert := flag.String("tls-cert", cfg.TLSCert, "Certificate file. Enables TLS.")
+	tlsKey := flag.String("tls-key", cfg.TLSKey, "Key file of the certificate.")
+	tlsCA := flag.String("tls-ca", cfg.TLSCA, "CA file to verify peers and client certificates.")
+	tlsClientAuth := flag.Bool("tls-client-auth", cfg.TLSClientAuth, "Require client certificates (mutual TLS).")
+	role := flag.String("role", cfg.Role, "master or replica.")
+	master := flag.String("master", cfg.Master, "Address of the master a replica redirects writes to.")
+	flag.Var(&replicas, "replica", "Replica as addr[=sync|async]. May be repeated.")
+	flag.Var(&lookups, "lookup", "Lookup server as addr[=cache,persist,parallel]. May be repeated.")
+
+	flag.Parse()
+
+	logger := NewLogger(os.Stderr, "")
+
+	if *configPath != "" {
+		err := loadConfig(*configPath, cfg)
+
+		if err != nil {
+			logger.Fatalf("[MYDBD] ERROR: config: %s", err.Error())
+		}
+	}
+
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			cfg.Listen = *listen
+		case "storage":
+			cfg.Storage = *storageType
+		case "path":
+			cfg.Path = *path
+		case "fsync":
+			cfg.Fsync = *fsync
+		case "loglevel":
+			cfg.LogLevel = *logLevel
+		case "shutdown-timeout":
+			cfg.ShutdownTimeout = *shutdownTimeout
+		case "read-timeout":
+			cfg.ReadTimeout = *readTimeout
+		case "write-timeout":
+			cfg.WriteTimeout = *writeTimeout
+		case "idle-timeout":
+			cfg.IdleTimeout = *idleTimeout
+		case "max-key-size":
+			cfg.MaxKeySize = *maxKeySize
+		case "max-value-size":
+			cfg.MaxValueSize = *maxValueSize
+		case "max-frame-size":
+			cfg.MaxFrameSize = *maxFrameSize
+		case "expiry-interval":
+			cfg.ExpiryInterval = *expiryInterval
+		case "tls-cert":
+			cfg.TLSCert = *tlsCert
+		case "tls-key":
+			cfg.TLSKey = *tlsKey
+		case "tls-ca":
+			cfg.TLSCA = *tlsCA
+		case "tls-client-auth":
+			cfg.TLSClientAuth = *tlsClientAuth
+		case "role":
+			cfg.Role = *role
+		case "master":
+			cfg.Master = *master
+		case "replica":
+			cfg.Replicas = replicas
+		case "lookup":
+			cfg.Lookups = lookups
+		}
+	})
+
+	lvl, ok := logLevels[cfg.LogLevel]
+
+	if !ok {
+		logger.Fatalf("[MYDBD] ERROR: unknown log level %q", cfg.LogLevel)
+	}
+
+	logger.SetLevel(lvl)
+
+	var s Storage
+
+	switch cfg.Storage {
+	case "memory":
+		s = NewMemoryStorage(logger)
+	case "ordered":
+		s = NewOrderedMemoryStorage(logger)
+	case "disk":
+		fsyncMode, ok := fsyncModes[cfg.Fsync]
+
+		if !ok {
+			logger.Fatalf("[MYDBD] ERROR: unknown fsync mode %q", cfg.Fsync)
+		}
+
+		if cfg.Path == "" {
+			logger.Fatal("[MYDBD] ERROR: disk storage needs a path")
+		}
+
+		ds, err := OpenDiskStorage(cfg.Path, &DiskConfig{SyncMode: fsyncMode}, logger)
+
+		if err != nil {
+			logger.Fatalf("[MYDBD] ERROR: storage: %s", err.Error())
+		}
+
+		s = ds
+	default:
+		logger.Fatalf("[MYDBD] ERROR: unknown storage %q", cfg.Storage)
+	}
+
+	var serverTLS *tls.Config = nil
+	engineConfig := &EngineConfig{}
+
+	if cfg.TLSCert != "" {
+		var err error
+
+		serverTLS, engineConfig.PeerTLS, err = loadTLS(cfg)
+
+		if err != nil {
+			logger.Fatalf("[MYDBD] ERROR: tls: %s", err.Error())
+		}
+	}
+
+	if len(cfg.Users) > 0 {
+		acl, err := buildACL(cfg.Users)
+
+		if err != nil {
+			logger.Fatalf("[MYDBD] ERROR: users: %s", err.Error())
+		}
+
+		engineConfig.ACL = acl
+	}
+
+	engineConfig.PeerUser = cfg.PeerUser
+	engineConfig.PeerToken = cfg.PeerToken
+
+	engineRole, ok := roles[cfg.Role]
+
+	if !ok {
+		logger.Fatalf("[MYDBD] ERROR: unknown role %q", cfg.Role)
+	}
+
+	if engineRole == ROLE_REPLICA && engineConfig.ACL == nil {
+		logger.Fatal("[MYDBD] ERROR: replica role needs users")
+	}
+
+	engineConfig.Role = engineRole
+	engineConfig.MasterAddr = cfg.Master
+
+	engineConfig.ReadTimeout = time.Duration(cfg.ReadTimeout) * time.Second
+	engineConfig.WriteTimeout = time.Duration(cfg.WriteTimeout) * time.Second
+	engineConfig.IdleTimeout = time.Duration(cfg.IdleTimeout) * time.Second
+
+	engineConfig.MaxKeySize = cfg.MaxKeySize
+	engineConfig.MaxValueSize = cfg.MaxValueSize
+	engineConfig.MaxFrameSize = cfg.MaxFrameSize
+
+	engineConfig.ExpiryInterval = time.Duration(cfg.ExpiryInterval) * time.Second
+
+	e := NewEngineWithConfig(s, logger, engineConfig)
+
+	for _, replica := range cfg.Replicas {
+		mode, ok := replModes[replica.Mode]
+
+		if !ok {
+			logger.Fatalf("[MYDBD] ERROR: unknown replication mode %q", replica.Mode)
+		}
+
+		raddr := replica.Addr
+		go addPeer(logger, "replica", raddr, func() error {
+			return e.AddReplica(raddr, mode)
+		})
+	}
+
+	for _, lookup := range cfg.Lookups {
+		mode, err := lookupMode(lookup.Mode)
+
+		if err != nil {
+			logger.Fatalf("[MYDBD] ERROR: %s", err.Error())
+		}
+
+		raddr := lookup.Addr
+		go addPeer(logger, "lookup server", raddr, func() error {
+			return e.AddLookup(raddr, mode)
+		})
+	}
+
+	serveErr := make(chan error, 1)
+
+	go func() {
+		if serverTLS != nil {
+			serveErr <- e.ServeTLS(cfg.Listen, serverTLS)
+		} else {
+			serveErr <- e.Serve(cfg.Listen)
+		}
+	}()
+
+	logger.Outf(LOGLVL_INFO, "[MYDBD] listening on %s", cfg.Listen)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	exitCode := 0
+
+	select {
+	case sig := <-signals:
+		logger.Outf(LOGLVL_INFO, "[MYDBD] received %s, shutting down", sig)
+	case err := <-serveErr:
+		logger.Outf(LOGLVL_ERROR, "[MYDBD] ERROR: serve: %v", err)
+		exitCode = 1
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownTimeout) * time.Second)
+	defer cancel()
+
+	err := e.Shutdown(ctx)
+
+	if err != nil && err != ErrEngineClosed {
+		logger.Outf(LOGLVL_ERROR, "[MYDBD] ERROR: shutdown: %s", err.Error())
+		exitCode = 1
+	}
+
+	os.Exit(exitCode)
 }
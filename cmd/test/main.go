@@ -39,13 +39,13 @@ func main() {
 
 	time.Sleep(2 * time.Second)
 
-	err := engine1.AddReplica("localhost:10002")
+	err := engine1.AddReplica("localhost:10002", REPLMODE_SYNC)
 
 	if err != nil {
 		log.Fatal(err.Error())
 	}
 
-	err = engine3.AddLookup("localhost:10002")
+	err = engine3.AddLookup("localhost:10002", LKUPMODE_DEFAULT)
 
 	if err != nil {
 		log.Fatal(err.Error())
@@ -1,8 +1,14 @@
 package mydb
 
+import (
+	"time"
+)
+
 type QMessage struct {
 	Msg Message
 	QResultChan chan *QResult
+	// Zero if there is none.
+	Deadline time.Time
 }
 
 type QResult struct {
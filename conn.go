@@ -1,16 +1,53 @@
 package mydb
 
 import (
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"io"
 	"net"
 	"encoding/binary"
 	"log"
 	"sync"
+	"time"
 )
 
+// Returned by ReadMessage if the read deadline passed before a
+// message started to arrive.
+var ErrIdleTimeout = errors.New("Connection idle for too long.")
+
+// Returned by ReadMessage if a message is larger than allowed. The
+// payload was not read so the connection can't be used any further.
+type FrameTooLargeError struct {
+	MId uint32
+	Size uint32
+}
+
+func (e *FrameTooLargeError) Error() string {
+	return fmt.Sprintf("Message %d too large (%d bytes).", e.MId, e.Size)
+}
+
 type MyConn struct {
 	conn net.Conn
 	mutex *sync.Mutex
+	// Zero means no timeout.
+	readTimeout time.Duration
+	writeTimeout time.Duration
+	// Zero means no limit.
+	maxFrameSize uint32
+}
+
+type ConnConfig struct {
+	// Once the first byte of a message arrived the rest has to
+	// arrive within ReadTimeout. Zero means no timeout.
+	ReadTimeout time.Duration
+
+	// Sending a message has to finish within WriteTimeout. Zero
+	// means no timeout.
+	WriteTimeout time.Duration
+
+	// Largest payload accepted. Zero means no limit.
+	MaxFrameSize uint32
 }
 
 
@@ -21,6 +58,16 @@ func NewMessageConn(conn net.Conn) MessageConn {
 	}
 }
 
+func NewMessageConnWithConfig(conn net.Conn, config *ConnConfig) MessageConn {
+	return &MyConn {
+		conn: conn,
+		mutex: &sync.Mutex{},
+		readTimeout: config.ReadTimeout,
+		writeTimeout: config.WriteTimeout,
+		maxFrameSize: config.MaxFrameSize,
+	}
+}
+
 func DialMessageConn(raddr string) (MessageConn, error) {
 	addr, err := net.ResolveTCPAddr("tcp", raddr)
 
@@ -40,6 +87,37 @@ func DialMessageConn(raddr string) (MessageConn, error) {
 	}, nil
 }
 
+// Like DialMessageConn but over TLS. For mutual TLS put the
+// client certificate into config.Certificates.
+func DialMessageConnTLS(raddr string, config *tls.Config) (MessageConn, error) {
+	conn, err := tls.Dial("tcp", raddr, config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &MyConn {
+		conn: conn,
+		mutex: &sync.Mutex{},
+	}, nil
+}
+
+func (mc *MyConn) String() string {
+	return mc.conn.RemoteAddr().String()
+}
+
+func (mc *MyConn) Close() error {
+	return mc.conn.Close()
+}
+
+func (mc *MyConn) SetReadDeadline(t time.Time) error {
+	return mc.conn.SetReadDeadline(t)
+}
+
+func (mc *MyConn) SetWriteDeadline(t time.Time) error {
+	return mc.conn.SetWriteDeadline(t)
+}
+
 func (mc *MyConn) Begin() {
 	mc.mutex.Lock()
 }
@@ -49,13 +127,40 @@ func (mc *MyConn) End() {
 }
 
 func (mc *MyConn) SendMessage(msg Message) error {
+	if mc.writeTimeout > 0 {
+		mc.conn.SetWriteDeadline(time.Now().Add(mc.writeTimeout))
+	}
+
 	return WriteMessage(mc.conn, msg)
 }
 
 func (mc *MyConn) ReadMessage() (Message, error) {
 	header := make([]byte, 9)
 
-	_, err := io.ReadFull(mc.conn, header)
+	// Waiting for the next message is bound by whatever read
+	// deadline the caller set.
+	_, err := io.ReadFull(mc.conn, header[:1])
+
+	if err != nil {
+		netErr, ok := err.(net.Error)
+
+		if ok && netErr.Timeout() {
+			return nil, ErrIdleTimeout
+		}
+
+		log.Printf("[CONN] ERROR: header: %s", err.Error())
+		return nil, err
+	}
+
+	if mc.readTimeout > 0 {
+		mc.conn.SetReadDeadline(time.Now().Add(mc.readTimeout))
+	} else {
+		// The deadline for the next message must not cut off the
+		// rest of this one.
+		mc.conn.SetReadDeadline(time.Time{})
+	}
+
+	_, err = io.ReadFull(mc.conn, header[1:])
 
 	if err != nil {
 		log.Printf("[CONN] ERROR: header: %s", err.Error())
@@ -66,6 +171,10 @@ func (mc *MyConn) ReadMessage() (Message, error) {
 	mtype := header[4]
 	lngth := binary.LittleEndian.Uint32(header[5:])
 
+	if mc.maxFrameSize > 0 && lngth > mc.maxFrameSize {
+		return nil, &FrameTooLargeError{MId: mid, Size: lngth}
+	}
+
 	payload := make([]byte, lngth)
 
 	_, err = io.ReadFull(mc.conn, payload)
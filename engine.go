@@ -1,67 +1,524 @@
 package mydb
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math"
 	"net"
+	"strconv"
 	"sync"
-	"math/rand"
+	"time"
 )
 
+// Returned by Serve once the engine has been shut down.
+var ErrEngineClosed = errors.New("Engine closed.")
+
+type EngineConfig struct {
+	// How long results of lookups done with LKUPMODE_CACHE are kept.
+	CacheTTL time.Duration
+
+	// Upper bound for asking all lookup servers.
+	LookupTimeout time.Duration
+
+	// How many operations may wait for an asynchronous replica.
+	// Beyond that they are dropped and the replica receives a new
+	// snapshot instead.
+	ReplicationQueueSize int
+
+	// Initial delay before replicating an operation again after
+	// a failure. Doubles with every further failure.
+	ReplicationRetry time.Duration
+
+	// Initial and maximum delay between attempts to connect to
+	// a replica or lookup server again.
+	ReconnectMin time.Duration
+	ReconnectMax time.Duration
+
+	// Upper bound for connecting to a replica or lookup server,
+	// including Hello and authentication.
+	PeerDialTimeout time.Duration
+
+	// Upper bound for a replica or lookup server to answer a
+	// request. A server that doesn't is connected to again, a
+	// replica then receives a new snapshot.
+	PeerTimeout time.Duration
+
+	// If set, replicas and lookup servers are connected to over
+	// TLS. For mutual TLS put the engine's certificate into
+	// PeerTLS.Certificates.
+	PeerTLS *tls.Config
+
+	// If set, clients have to authenticate as one of its users
+	// and may only do what the user was granted.
+	ACL *ACL
+
+	// Credentials to authenticate with at replicas and lookup
+	// servers. Not sent if PeerUser is empty.
+	PeerUser string
+	PeerToken string
+
+	// ROLE_MASTER (the default) or ROLE_REPLICA. A replica only
+	// accepts writes from users with PERM_REPLICATE and thus needs
+	// an ACL. Other clients are redirected to MasterAddr if set.
+	Role uint8
+	MasterAddr string
+
+	// How long a client may take to send the rest of a message
+	// once it started and to take a response. Zero means forever.
+	ReadTimeout time.Duration
+	WriteTimeout time.Duration
+
+	// Connections without a request for this long are closed. Zero
+	// means never.
+	IdleTimeout time.Duration
+
+	// Largest key, value and message in bytes accepted from
+	// clients. Advertised to clients asking with a Limits message.
+	MaxKeySize int
+	MaxValueSize int
+	MaxFrameSize int
+
+	// How often a master looks for expired entries to delete. Until
+	// then they are hidden from clients.
+	ExpiryInterval time.Duration
+
+	// Most entries answered to a single Scan.
+	MaxScanLimit int
+}
+
+const DEFAULT_CACHE_TTL = 60 * time.Second
+const DEFAULT_LOOKUP_TIMEOUT = 5 * time.Second
+const DEFAULT_REPLICATION_QUEUE_SIZE = 4096
+const DEFAULT_REPLICATION_RETRY = 500 * time.Millisecond
+const DEFAULT_RECONNECT_MIN = 100 * time.Millisecond
+const DEFAULT_RECONNECT_MAX = 30 * time.Second
+const DEFAULT_PEER_DIAL_TIMEOUT = 10 * time.Second
+const DEFAULT_PEER_TIMEOUT = 10 * time.Second
+const DEFAULT_MAX_KEY_SIZE = 0xFFFF
+const DEFAULT_MAX_VALUE_SIZE = 16 * 1024 * 1024
+const DEFAULT_MAX_FRAME_SIZE = 32 * 1024 * 1024
+const DEFAULT_EXPIRY_INTERVAL = 60 * time.Second
+const DEFAULT_MAX_SCAN_LIMIT = 1000
+
+// Longest TTL accepted. Expiry times are kept in nanoseconds since
+// 1970, which run out in 2262.
+const MAX_TTL = 100 * 365 * 24 * time.Hour
+
+type EngineStats struct {
+	Replicas []ReplicaStats
+	Lookups []LookupStats
+
+	// Connections closed because they were idle for too long or
+	// a read or write took too long.
+	IdleClosed uint64
+	TimedOut uint64
+
+	// Expired entries deleted.
+	Expired uint64
+}
+
+type LookupStats struct {
+	Addr string
+	Mode uint8
+
+	// One of PEERSTATE_*.
+	State uint8
+}
+
 type DefaultEngine struct {
-	replicas []MessageConn
-	lookups []MessageConn
+	replicas []*replica
+	lookups []*lookupPeer
 	storage Storage
+	cache *lookupCache
 	mutex *sync.RWMutex
+	// Serializes writes so the local storage and the replicas
+	// see them in the same order.
+	wmutex *sync.Mutex
 	logger Logger
+	config EngineConfig
+
+	// Guard the fields below.
+	connMutex *sync.Mutex
+	closing bool
+	listeners map[net.Listener]struct{}
+	conns map[*serverConn]struct{}
+	connWg *sync.WaitGroup
+	idleClosed uint64
+	timedOut uint64
+	expired uint64
+
+	// Closed to stop the expiry sweeper.
+	done chan struct{}
+	sweepWg *sync.WaitGroup
+
+	// Keys received since the master began a snapshot, nil if
+	// none is running. Guarded by wmutex.
+	snapshotKeys map[string]struct{}
+
+	// The last version handed out. Guarded by wmutex.
+	version uint64
+}
+
+type serverConn struct {
+	mconn MessageConn
+	// Processing a request right now.
+	busy bool
+	// Who authenticated on this connection.
+	user *User
+	// Agreed on in the Hello exchange. Clients that don't send
+	// a Hello speak version 0 without any capabilities.
+	version uint16
+	caps uint32
+	// Received a message already.
+	started bool
+}
+
+type lookupPeer struct {
+	peer *peer
+	mode uint8
 }
 
 func NewEngine(s Storage, logger Logger) Engine {
-	return &DefaultEngine {
+	return NewEngineWithConfig(s, logger, &EngineConfig{})
+}
+
+// Creates an engine. Zero values in the config are replaced
+// by their defaults.
+func NewEngineWithConfig(s Storage, logger Logger, config *EngineConfig) Engine {
+	cfg := *config
+
+	if cfg.CacheTTL == 0 {
+		cfg.CacheTTL = DEFAULT_CACHE_TTL
+	}
+
+	if cfg.LookupTimeout == 0 {
+		cfg.LookupTimeout = DEFAULT_LOOKUP_TIMEOUT
+	}
+
+	if cfg.ReplicationQueueSize == 0 {
+		cfg.ReplicationQueueSize = DEFAULT_REPLICATION_QUEUE_SIZE
+	}
+
+	if cfg.ReplicationRetry == 0 {
+		cfg.ReplicationRetry = DEFAULT_REPLICATION_RETRY
+	}
+
+	if cfg.ReconnectMin == 0 {
+		cfg.ReconnectMin = DEFAULT_RECONNECT_MIN
+	}
+
+	if cfg.ReconnectMax == 0 {
+		cfg.ReconnectMax = DEFAULT_RECONNECT_MAX
+	}
+
+	if cfg.PeerDialTimeout == 0 {
+		cfg.PeerDialTimeout = DEFAULT_PEER_DIAL_TIMEOUT
+	}
+
+	if cfg.PeerTimeout == 0 {
+		cfg.PeerTimeout = DEFAULT_PEER_TIMEOUT
+	}
+
+	if cfg.Role == 0 {
+		cfg.Role = ROLE_MASTER
+	}
+
+	if cfg.MaxKeySize == 0 {
+		cfg.MaxKeySize = DEFAULT_MAX_KEY_SIZE
+	}
+
+	if cfg.MaxValueSize == 0 {
+		cfg.MaxValueSize = DEFAULT_MAX_VALUE_SIZE
+	}
+
+	if cfg.MaxFrameSize == 0 {
+		cfg.MaxFrameSize = DEFAULT_MAX_FRAME_SIZE
+	}
+
+	if cfg.ExpiryInterval == 0 {
+		cfg.ExpiryInterval = DEFAULT_EXPIRY_INTERVAL
+	}
+
+	if cfg.MaxScanLimit == 0 {
+		cfg.MaxScanLimit = DEFAULT_MAX_SCAN_LIMIT
+	}
+
+	de := &DefaultEngine {
 		storage: s,
+		cache: newLookupCache(cfg.CacheTTL),
 		mutex: &sync.RWMutex{},
+		wmutex: &sync.Mutex{},
 		logger: logger,
+		config: cfg,
+		connMutex: &sync.Mutex{},
+		listeners: make(map[net.Listener]struct{}),
+		conns: make(map[*serverConn]struct{}),
+		connWg: &sync.WaitGroup{},
+		done: make(chan struct{}),
+		sweepWg: &sync.WaitGroup{},
+	}
+
+	if cfg.Role == ROLE_MASTER {
+		de.sweepWg.Add(1)
+		go de.sweepLoop()
 	}
+
+	return de
 }
 
-func (de *DefaultEngine) AddReplica(raddr string) error {
+// Adds a server all writes are forwarded to. The mode is either
+// REPLMODE_SYNC or REPLMODE_ASYNC. The server first receives all
+// entries already stored, writes made in the meantime are queued
+// and replayed afterwards.
+func (de *DefaultEngine) AddReplica(raddr string, mode uint8) error {
 
-	mconn, err := DialMessageConn(raddr)
+	peer, err := de.dialPeer(raddr)
 
 	if err != nil {
 		de.logger.Outf(LOGLVL_ERROR, "[ENGINE] ERROR: %s", err.Error())
 		return err
 	}
 
+	de.wmutex.Lock()
+	defer de.wmutex.Unlock()
+
 	de.mutex.Lock()
 	defer de.mutex.Unlock()
 
-	de.replicas = append(de.replicas, mconn)
+	if de.isClosing() {
+		peer.close()
+		return ErrEngineClosed
+	}
+
+	replica := newReplica(raddr, mode, peer, de.storage, de.wmutex, de.config.ReplicationQueueSize, de.config.ReplicationRetry, de.config.MaxFrameSize, de.logger)
+
+	de.replicas = append(de.replicas, replica)
 
 	return nil
 }
 
-func (de *DefaultEngine) AddLookup(raddr string) error {
+// Adds a server to ask for entries not found locally. The mode
+// is a combination of LKUPMODE_* flags and decides what happens
+// with a result from this server.
+func (de *DefaultEngine) AddLookup(raddr string, mode uint8) error {
 
-	mconn, err := DialMessageConn(raddr)
+	peer, err := de.dialPeer(raddr)
 
 	if err != nil {
 		de.logger.Outf(LOGLVL_ERROR, "[ENGINE] ERROR: %s", err.Error())
+		return err
 	}
 
 	de.mutex.Lock()
 	defer de.mutex.Unlock()
 
-	de.lookups = append(de.lookups, mconn)
+	if de.isClosing() {
+		peer.close()
+		return ErrEngineClosed
+	}
+
+	de.lookups = append(de.lookups, &lookupPeer{peer: peer, mode: mode})
 
 	return nil
 }
 
+func (de *DefaultEngine) dialPeer(raddr string) (*peer, error) {
+	dial := func() (*pipeline, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), de.config.PeerDialTimeout)
+		defer cancel()
+
+		return dialPipeline(ctx, raddr, de.config.PeerTLS, de.config.PeerUser, de.config.PeerToken)
+	}
+
+	return dialPeer(raddr, dial, de.config.PeerTimeout, de.config.ReconnectMin, de.config.ReconnectMax, de.logger)
+}
+
+func (de *DefaultEngine) Stats() *EngineStats {
+	de.mutex.RLock()
+	replicas := de.replicas
+	lookups := de.lookups
+	de.mutex.RUnlock()
+
+	stats := &EngineStats{
+		Replicas: make([]ReplicaStats, len(replicas)),
+		Lookups: make([]LookupStats, len(lookups)),
+	}
+
+	for i, replica := range replicas {
+		stats.Replicas[i] = replica.stats()
+	}
+
+	for i, lookup := range lookups {
+		stats.Lookups[i] = LookupStats{
+			Addr: lookup.peer.raddr,
+			Mode: lookup.mode,
+			State: lookup.peer.State(),
+		}
+	}
+
+	de.connMutex.Lock()
+	stats.IdleClosed = de.idleClosed
+	stats.TimedOut = de.timedOut
+	stats.Expired = de.expired
+	de.connMutex.Unlock()
+
+	return stats
+}
+
 func (de *DefaultEngine) Serve(laddr string) error {
-	return de.acceptLoop(laddr)
+	return de.acceptLoop(laddr, nil)
+}
+
+// Like Serve but clients have to connect over TLS. To require client
+// certificates (mutual TLS) set config.ClientAuth to
+// tls.RequireAndVerifyClientCert and config.ClientCAs accordingly.
+func (de *DefaultEngine) ServeTLS(laddr string, config *tls.Config) error {
+	return de.acceptLoop(laddr, config)
+}
+
+// Stops accepting connections, lets requests being processed finish,
+// waits for the replication queues to drain and closes the peer
+// connections and the storage. If ctx is done before that, remaining
+// connections are closed forcibly, queued replication is dropped and
+// ctx's error is returned.
+func (de *DefaultEngine) Shutdown(ctx context.Context) error {
+	de.connMutex.Lock()
+
+	if de.closing {
+		de.connMutex.Unlock()
+		return ErrEngineClosed
+	}
+
+	de.closing = true
+	close(de.done)
+
+	for listener := range de.listeners {
+		listener.Close()
+	}
+
+	// Busy connections are closed by their connLoop once
+	// the response is out.
+	for sconn := range de.conns {
+		if !sconn.busy {
+			sconn.mconn.Close()
+		}
+	}
+
+	de.connMutex.Unlock()
+
+	drained := make(chan struct{})
+
+	go func() {
+		de.connWg.Wait()
+		close(drained)
+	}()
+
+	var err error = nil
+
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+
+		de.connMutex.Lock()
+		for sconn := range de.conns {
+			sconn.mconn.Close()
+		}
+		de.connMutex.Unlock()
+	}
+
+	// Deletes of expired entries have to be through before
+	// replication is flushed.
+	de.sweepWg.Wait()
+
+	de.mutex.RLock()
+	replicas := de.replicas
+	lookups := de.lookups
+	de.mutex.RUnlock()
+
+	if err == nil {
+		err = de.flushReplication(ctx, replicas)
+	}
+
+	for _, replica := range replicas {
+		replica.close()
+	}
+
+	for _, lookup := range lookups {
+		lookup.peer.close()
+	}
+
+	serr := de.storage.Close()
+
+	if err == nil && serr != nil {
+		err = serr
+	}
+
+	de.logger.Out(LOGLVL_INFO, "[ENGINE] shut down")
+
+	return err
+}
+
+// Shuts down right away without waiting for anything.
+func (de *DefaultEngine) Close() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := de.Shutdown(ctx)
+
+	if err == context.Canceled {
+		return nil
+	}
+
+	return err
+}
+
+// Waits until all replicas have acknowledged everything queued for them.
+func (de *DefaultEngine) flushReplication(ctx context.Context, replicas []*replica) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		pending := false
+
+		for _, replica := range replicas {
+			stats := replica.stats()
+
+			if stats.Queued != 0 || stats.Bootstrapping {
+				pending = true
+				break
+			}
+		}
+
+		if !pending {
+			return nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (de *DefaultEngine) isClosing() bool {
+	de.connMutex.Lock()
+	defer de.connMutex.Unlock()
+
+	return de.closing
 }
 
-func (de *DefaultEngine) acceptLoop(laddr string) error {
+func (de *DefaultEngine) acceptLoop(laddr string, tlsConfig *tls.Config) error {
 	de.logger.Out(LOGLVL_VERBOSE, "[ENGINE] begin acceptLoop")
 
+	if de.config.Role == ROLE_REPLICA && de.config.ACL == nil {
+		// Can't tell the master from anybody else.
+		return errors.New("Replica role needs an ACL.")
+	}
+
 	sck, err := net.Listen("tcp", laddr)
 
 	if err != nil {
@@ -69,179 +526,1091 @@ func (de *DefaultEngine) acceptLoop(laddr string) error {
 		return err
 	}
 
+	if tlsConfig != nil {
+		sck = tls.NewListener(sck, tlsConfig)
+	}
+
+	de.connMutex.Lock()
+
+	if de.closing {
+		de.connMutex.Unlock()
+		sck.Close()
+		return ErrEngineClosed
+	}
+
+	de.listeners[sck] = struct{}{}
+
+	de.connMutex.Unlock()
+
 	for {
-		conn, err := sck.Accept()
+		var conn net.Conn
+
+		conn, err = sck.Accept()
 
 		if err != nil {
+			if de.isClosing() {
+				err = ErrEngineClosed
+				break
+			}
+
 			de.logger.Outf(LOGLVL_ERROR, "[ENGINE] ERROR: %s", err.Error())
+			err = nil
 			break
 		}
 
-		go de.connLoop(NewMessageConn(conn))
+		sconn := &serverConn{mconn: NewMessageConnWithConfig(conn, &ConnConfig{
+			ReadTimeout: de.config.ReadTimeout,
+			WriteTimeout: de.config.WriteTimeout,
+			MaxFrameSize: uint32(de.config.MaxFrameSize),
+		})}
+
+		de.connMutex.Lock()
+
+		if de.closing {
+			de.connMutex.Unlock()
+			conn.Close()
+			continue
+		}
+
+		de.conns[sconn] = struct{}{}
+		de.connWg.Add(1)
+
+		de.connMutex.Unlock()
+
+		go de.connLoop(sconn)
 	}
 
+	de.connMutex.Lock()
+	delete(de.listeners, sck)
+	de.connMutex.Unlock()
+
+	sck.Close()
+
 	de.logger.Out(LOGLVL_VERBOSE, "[ENGINE] exit acceptLoop")
-	return nil
+	return err
+}
+
+// Marks the connection as busy or idle. Returns false if the
+// engine is shutting down and the connection should be closed.
+func (de *DefaultEngine) setBusy(sconn *serverConn, busy bool) bool {
+	de.connMutex.Lock()
+	defer de.connMutex.Unlock()
+
+	sconn.busy = busy
+
+	return !de.closing
 }
 
-func (de *DefaultEngine) connLoop(conn MessageConn) error {
+// Requests on a connection are processed in the order they arrive.
+// Clients may send further requests before reading the responses,
+// every response carries the id of its request.
+func (de *DefaultEngine) connLoop(sconn *serverConn) error {
 	de.logger.Out(LOGLVL_VERBOSE, "[ENGINE] begin connLoop")
 
+	conn := sconn.mconn
+
+	defer func() {
+		de.connMutex.Lock()
+		delete(de.conns, sconn)
+		de.connMutex.Unlock()
+
+		de.connWg.Done()
+	}()
+
 	for {
+		if !de.setBusy(sconn, false) {
+			break
+		}
+
+		// Also clears what is left of the read timeout of the
+		// previous message.
+		idleDeadline := time.Time{}
+
+		if de.config.IdleTimeout > 0 {
+			idleDeadline = time.Now().Add(de.config.IdleTimeout)
+		}
+
+		conn.SetReadDeadline(idleDeadline)
+
 		msg, err := conn.ReadMessage()
 
-		if err != nil {
+		if err == ErrIdleTimeout {
+			de.logger.Outf(LOGLVL_INFO, "[ENGINE] closing idle connection %s", conn)
+			de.countTimeout(&de.idleClosed)
+			break
+		}
+
+		unknownType, ok := err.(*UnknownTypeError)
+
+		if ok {
+			de.logger.Outf(LOGLVL_ERROR, "[ENGINE] ERROR: %s", err.Error())
+			err = conn.SendMessage(de.errorResponse(sconn, unknownType.MId, EngineErrorf(ERR_UNSUPPORTED, "Unknown message type %d.", unknownType.MType)))
+
+			if err != nil {
+				de.logger.Outf(LOGLVL_ERROR, "[ENGINE] ERROR: %s", err.Error())
+				break
+			}
+
+			sconn.started = true
+			continue
+		}
+
+		tooLarge, ok := err.(*FrameTooLargeError)
+
+		if ok {
+			// Tell the client why before hanging up, the rest of
+			// the message is still on the wire.
 			de.logger.Outf(LOGLVL_ERROR, "[ENGINE] ERROR: %s", err.Error())
+			conn.SendMessage(de.errorResponse(sconn, tooLarge.MId, EngineErrorf(ERR_TOOLARGE, "Message too large (%d bytes).", tooLarge.Size)))
+			break
+		}
+
+		if err != nil {
+			if !de.isClosing() {
+				de.logger.Outf(LOGLVL_ERROR, "[ENGINE] ERROR: %s", err.Error())
+				de.countNetTimeout(err)
+			}
+			break
+		}
+
+		if !de.setBusy(sconn, true) {
+			// Shutdown closed the connection while the message
+			// was read. Nobody could be told the outcome, so it
+			// isn't processed at all.
+			de.logger.Outf(LOGLVL_INFO, "[ENGINE] dropping %s, shutting down", msg)
 			break
 		}
 
 		de.logger.Outf(LOGLVL_INFO, "[ENGINE] Message received: %s", msg)
 
-		retMsg, perr := de.ProcessMessage(msg)
+		var retMsg Message
+		var perr EngineError
+
+		authMsg, isAuth := msg.(*Auth)
+		helloMsg, isHello := msg.(*Hello)
+
+		if isHello {
+			retMsg, perr = de.hello(sconn, helloMsg)
+		} else if isAuth {
+			retMsg, perr = de.authenticate(sconn, authMsg)
+		} else {
+			retMsg, perr = de.ProcessMessageAs(sconn.user, msg)
+		}
+
+		sconn.started = true
+
+		redirectMsg, isRedirect := retMsg.(*Redirect)
+
+		if isRedirect && sconn.caps & CAP_REDIRECT == 0 {
+			perr = EngineErrorf(ERR_READONLY, "Read-only replica, master is %s.", redirectMsg.Addr)
+		}
+
+		vresultMsg, isVResult := retMsg.(*VResult)
+
+		if isVResult && sconn.caps & CAP_VERSIONS == 0 {
+			retMsg = &Result{MId: vresultMsg.MId, Data: vresultMsg.Data}
+		}
 
 		if perr != nil {
 			de.logger.Outf(LOGLVL_ERROR, "[ENGINE] ERROR: %s", perr.Error())
-			conn.SendMessage(&Status{MId: msg.Id(), StatusCode: perr.ErrCode()})
-			break
+			retMsg = de.errorResponse(sconn, msg.Id(), perr)
 		}
 
 		err = conn.SendMessage(retMsg)
 
 		if err != nil {
 			de.logger.Outf(LOGLVL_ERROR, "[ENGINE] ERROR: %s", err.Error())
+			de.countNetTimeout(err)
+			break
+		}
+
+		// No second guess on the same connection.
+		if isAuth && perr != nil {
 			break
 		}
 	}
 
+	conn.Close()
+
 	de.logger.Out(LOGLVL_VERBOSE, "[ENGINE] exit connLoop")
 	return nil
 }
 
-func (de *DefaultEngine) Lookup(getMsg *Get) ([]byte, EngineError) {
-	de.mutex.RLock()
-	lookups := de.lookups
-	de.mutex.RUnlock()
+// An Error for clients that agreed on CAP_ERRDETAIL, a Status for
+// all others.
+func (de *DefaultEngine) errorResponse(sconn *serverConn, mid uint32, perr EngineError) Message {
+	if sconn.caps & CAP_ERRDETAIL == 0 {
+		return &Status{MId: mid, StatusCode: perr.ErrCode()}
+	}
 
-	if len(lookups) == 0 {
-		return nil, nil
+	text := perr.Msg()
+
+	if perr.Cause() != nil {
+		text = fmt.Sprintf("%s (Cause: %s)", text, perr.Cause().Error())
 	}
 
-	var err error = nil
+	if len(text) > 0xFFFF {
+		text = text[:0xFFFF]
+	}
 
-	for i := 0; i < len(lookups); i++ {
-		j := rand.Intn(len(lookups))
+	return &Error{
+		MId: mid,
+		Code: perr.ErrCode(),
+		Msg: []byte(text),
+		Peer: []byte(perr.Peer()),
+	}
+}
 
-		lookup := lookups[j]
+func (de *DefaultEngine) countTimeout(counter *uint64) {
+	de.connMutex.Lock()
+	*counter++
+	de.connMutex.Unlock()
+}
 
-		lookup.Begin()
+// Counts err if a read or write deadline passed.
+func (de *DefaultEngine) countNetTimeout(err error) {
+	netErr, ok := err.(net.Error)
 
-		lookup.SendMessage(getMsg)
+	if ok && netErr.Timeout() {
+		de.countTimeout(&de.timedOut)
+	}
+}
 
-		retMsg, errNew := lookup.ReadMessage()
+func (de *DefaultEngine) hello(sconn *serverConn, helloMsg *Hello) (Message, EngineError) {
+	if sconn.started {
+		return nil, EngineErrorf(ERR_UNSUPPORTED, "Hello must be the first message.")
+	}
 
-		lookup.End()
+	respMsg := negotiate(helloMsg)
 
-		if errNew != nil {
-			de.logger.Outf(LOGLVL_ERROR, "[ENGINE] ERROR: %s", err.Error())
-			err = errNew
-		} else {
-			switch retMsg.(type) {
-			case *Status:
-				err = EngineErrorf(ERR_LOOKUP, "Error on lookup: Status code received was %d.", retMsg.(*Status).StatusCode)
-			case *Result:
-				return retMsg.(*Result).Data, nil
-			default:
-				err = EngineErrorf(ERR_LOOKUP, "Server responded with wrong message type.")
-			}
-		}
+	sconn.version = respMsg.Version
+	sconn.caps = respMsg.Caps
+
+	return respMsg, nil
+}
+
+func (de *DefaultEngine) authenticate(sconn *serverConn, authMsg *Auth) (Message, EngineError) {
+	if de.config.ACL == nil {
+		return &Status{MId: authMsg.MId, StatusCode: 0}, nil
+	}
+
+	user := de.config.ACL.Authenticate(authMsg.User, authMsg.Token)
+
+	if user == nil {
+		return nil, EngineErrorf(ERR_AUTH, "Authentication failed for %q.", authMsg.User)
 	}
 
-	return nil, EngineErrorf2(ERR_LOOKUP, err, "Lookup error.")
+	sconn.user = user
+
+	return &Status{MId: authMsg.MId, StatusCode: 0}, nil
 }
 
-func (de *DefaultEngine) Replicate(putMsg *Put) EngineError {
-	de.mutex.RLock()
-	replicas := de.replicas
-	de.mutex.RUnlock()
+// Checks whether the user may do what msg asks for. Without an ACL
+// everything is allowed, user is nil then.
+func (de *DefaultEngine) authorize(user *User, msg Message) EngineError {
+	if de.config.ACL == nil {
+		return nil
+	}
 
-	for _, replica := range replicas {
-		replica.Begin()
+	_, isLimits := msg.(*Limits)
 
-		replica.SendMessage(putMsg)
-		retMsg, err := replica.ReadMessage()
+	if isLimits {
+		// Nothing secret, clients may want to know before
+		// authenticating.
+		return nil
+	}
 
-		replica.End()
+	if user == nil {
+		return EngineErrorf(ERR_AUTH, "Not authenticated.")
+	}
 
-		if err != nil {
-			return EngineErrorf(ERR_REPLICATE, "Error replicating to %s: %s", replica, err.Error())
-		}
+	keys, _, write, ok := requestKeys(msg)
 
-		if retMsg.Id() != putMsg.Id() {
-			return EngineErrorf(ERR_REPLICATE, "Error replicating to %s: MessageIds don't match.", replica)
+	if !ok {
+		return EngineErrorf(ERR_DENIED, "%s may not send this message type.", user.Name)
+	}
+
+	_, isRPut := msg.(*RPut)
+	_, isSnapshot := msg.(*Snapshot)
+
+	perms := PERM_READ
+
+	if isRPut || isSnapshot || (write && de.config.Role == ROLE_REPLICA) {
+		// Only replication may set versions.
+		perms = PERM_REPLICATE
+	} else if write {
+		perms = PERM_WRITE
+	}
+
+	// Batches are allowed as a whole or not at all.
+	for _, key := range keys {
+		if perms == PERM_REPLICATE && de.config.Role == ROLE_REPLICA && !user.Allowed(key, perms) {
+			return EngineErrorf(ERR_READONLY, "%s may not write to a replica.", user.Name)
 		}
 
-		switch retMsg.(type) {
-		case *Status:
-			statusMsg := retMsg.(*Status)
-			if statusMsg.StatusCode != 0 {
-				return EngineErrorf(ERR_REPLICATE, "Error replicating to %s: Status code received was %d", replica, statusMsg.StatusCode)
-			}
-		default:
-			return EngineErrorf(ERR_REPLICATE, "Wrong message received from %s.", replica)
+		if !user.Allowed(key, perms) {
+			return EngineErrorf(ERR_DENIED, "%s may not do this on %x.", user.Name, key)
 		}
 	}
 
 	return nil
 }
 
-func (de *DefaultEngine) ProcessMessage(msg Message) (Message, EngineError) {
+// The keys and values a request carries and whether it writes. Not
+// ok for messages that aren't requests on keys.
+func requestKeys(msg Message) ([][]byte, [][]byte, bool, bool) {
 	switch msg.(type) {
+	case *Get:
+		return [][]byte{msg.(*Get).Key}, nil, false, true
+	case *LGet:
+		return [][]byte{msg.(*LGet).Key}, nil, false, true
+	case *MGet:
+		return msg.(*MGet).Keys, nil, false, true
+	case *Scan:
+		// Grants are on prefixes, so whoever may read the prefix
+		// may read every key the scan returns.
+		return [][]byte{msg.(*Scan).Prefix}, nil, false, true
 	case *Put:
-		putMsg := msg.(*Put)
+		return [][]byte{msg.(*Put).Key}, [][]byte{msg.(*Put).Value}, true, true
+	case *MPut:
+		return msg.(*MPut).Keys, msg.(*MPut).Values, true, true
+	case *Delete:
+		return [][]byte{msg.(*Delete).Key}, nil, true, true
+	case *Incr:
+		return [][]byte{msg.(*Incr).Key}, nil, true, true
+	case *PutTTL:
+		return [][]byte{msg.(*PutTTL).Key}, [][]byte{msg.(*PutTTL).Value}, true, true
+	case *CAS:
+		return [][]byte{msg.(*CAS).Key}, [][]byte{msg.(*CAS).Value}, true, true
+	case *RPut:
+		return msg.(*RPut).Keys, msg.(*RPut).Values, true, true
+	case *Snapshot:
+		// May delete any key.
+		return [][]byte{[]byte{}}, nil, true, true
+	}
 
-		key := putMsg.Key
-		value := putMsg.Value
+	return nil, nil, false, false
+}
 
-		err := de.Replicate(putMsg)
+// Like ProcessMessage but only if user is allowed to. Writes to a
+// replica are answered with a Redirect to the master if one is known.
+func (de *DefaultEngine) ProcessMessageAs(user *User, msg Message) (Message, EngineError) {
+	err := de.authorize(user, msg)
 
-		if err != nil {
-			return nil, err
+	if err != nil {
+		if err.ErrCode() == ERR_READONLY && de.config.MasterAddr != "" {
+			return &Redirect{MId: msg.Id(), Addr: []byte(de.config.MasterAddr)}, nil
 		}
 
-		serr := de.storage.Put(key, value)
+		return nil, err
+	}
 
-		if serr != nil {
-			return nil, EngineErrorf2(ERR_STORAGE, serr, "Storage error.")
+	return de.ProcessMessage(msg)
+}
+
+// Asks the lookup servers for an entry not found locally. Servers
+// added with LKUPMODE_PARALLEL are asked all at the same time, the
+// others one at a time in the order they were added. Returns nil
+// without error if no server has the entry.
+func (de *DefaultEngine) Lookup(getMsg *Get) ([]byte, EngineError) {
+	de.mutex.RLock()
+	lookups := de.lookups
+	de.mutex.RUnlock()
+
+	if len(lookups) == 0 {
+		return nil, nil
+	}
+
+	cached := de.cache.get(getMsg.Key)
+
+	if cached != nil {
+		return cached, nil
+	}
+
+	parallel := make([]*lookupPeer, 0, len(lookups))
+	sequential := make([]*lookupPeer, 0, len(lookups))
+
+	for _, lookup := range lookups {
+		if lookup.mode & LKUPMODE_PARALLEL != 0 {
+			parallel = append(parallel, lookup)
+		} else {
+			sequential = append(sequential, lookup)
+		}
+	}
+
+	timer := time.NewTimer(de.config.LookupTimeout)
+	defer timer.Stop()
+
+	var err error = nil
+	errPeer := ""
+
+	if len(parallel) > 0 {
+		// Buffered so late answers don't block after we returned.
+		answers := make(chan *lookupAnswer, len(parallel))
+
+		for _, lookup := range parallel {
+			go de.ask(lookup, getMsg, answers)
+		}
+
+		for i := 0; i < len(parallel); i++ {
+			select {
+			case answer := <-answers:
+				if answer.err != nil {
+					err = answer.err
+					errPeer = answer.lookup.peer.raddr
+				} else if answer.data != nil {
+					de.keepLookupResult(answer.lookup.mode, getMsg.Key, answer.data)
+					return answer.data, nil
+				}
+			case <-timer.C:
+				return nil, EngineErrorf(ERR_LOOKUP, "Lookup timed out.")
+			}
+		}
+	}
+
+	for _, lookup := range sequential {
+		answers := make(chan *lookupAnswer, 1)
+
+		go de.ask(lookup, getMsg, answers)
+
+		select {
+		case answer := <-answers:
+			if answer.err != nil {
+				err = answer.err
+				errPeer = answer.lookup.peer.raddr
+			} else if answer.data != nil {
+				de.keepLookupResult(answer.lookup.mode, getMsg.Key, answer.data)
+				return answer.data, nil
+			}
+		case <-timer.C:
+			return nil, EngineErrorf(ERR_LOOKUP, "Lookup timed out.")
+		}
+	}
+
+	if err != nil {
+		return nil, EngineErrorf3(ERR_LOOKUP, err, errPeer, "Lookup error.")
+	}
+
+	return nil, nil
+}
+
+type lookupAnswer struct {
+	lookup *lookupPeer
+	data []byte
+	err error
+}
+
+// Asks a single lookup server. An answer with neither data nor
+// error means the server doesn't have the entry either.
+func (de *DefaultEngine) ask(lookup *lookupPeer, getMsg *Get, answers chan *lookupAnswer) {
+	answer := &lookupAnswer{lookup: lookup}
+
+	retMsg, err := lookup.peer.roundTrip(&LGet{Key: getMsg.Key})
+
+	if err == ErrUnsupported {
+		// Older servers forward it to their own lookup servers.
+		retMsg, err = lookup.peer.roundTrip(getMsg)
+	}
+
+	if err != nil {
+		de.logger.Outf(LOGLVL_ERROR, "[ENGINE] ERROR: %s", err.Error())
+		answer.err = err
+		answers <- answer
+		return
+	}
+
+	switch retMsg.(type) {
+	case *Status:
+		statusCode := retMsg.(*Status).StatusCode
+
+		if statusCode != ERR_NOTEXISTS {
+			answer.err = EngineErrorf3(ERR_LOOKUP, nil, lookup.peer.raddr, "Error on lookup: Status code received was %d.", statusCode)
+		}
+	case *Error:
+		errorMsg := retMsg.(*Error)
+
+		if errorMsg.Code != ERR_NOTEXISTS {
+			answer.err = EngineErrorf3(ERR_LOOKUP, nil, lookup.peer.raddr, "Error on lookup: Status code received was %d: %s", errorMsg.Code, errorMsg.Msg)
+		}
+	case *Result:
+		answer.data = retMsg.(*Result).Data
+	case *VResult:
+		answer.data = retMsg.(*VResult).Data
+	default:
+		answer.err = EngineErrorf3(ERR_LOOKUP, nil, lookup.peer.raddr, "Server responded with wrong message type.")
+	}
+
+	answers <- answer
+}
+
+// Stores a result obtained from a lookup server according to
+// the mode the server was added with. A persisted result is written
+// and replicated like a Put, unless the key was written while the
+// lookup was running.
+func (de *DefaultEngine) keepLookupResult(mode uint8, key []byte, value []byte) {
+	if mode & LKUPMODE_PERSIST != 0 {
+		var rputMsg *RPut
+
+		err := de.write(func() (Message, EngineError) {
+			current, serr := de.storage.GetEntry(key)
+
+			if serr != nil {
+				return nil, EngineErrorf2(ERR_STORAGE, serr, "Storage error.")
+			}
+
+			if current != nil && !current.Expired(time.Now()) {
+				return nil, nil
+			}
+
+			var perr EngineError
+			rputMsg, perr = de.nextVersions([][]byte{key}, [][]byte{value}, time.Time{})
+			return rputMsg, perr
+		}, func() StorageError {
+			return de.storage.PutEntry(key, rputMsg.entry(0))
+		})
+
+		if err != nil {
+			de.logger.Outf(LOGLVL_ERROR, "[ENGINE] ERROR: %s", err.Error())
+		}
+	} else if mode & LKUPMODE_CACHE != 0 {
+		de.cache.put(key, value)
+	}
+}
+
+// Forwards a Put or Delete to all synchronous replicas.
+func (de *DefaultEngine) Replicate(msg Message) EngineError {
+	de.mutex.RLock()
+	replicas := de.replicas
+	de.mutex.RUnlock()
+
+	for _, replica := range replicas {
+		if replica.queueing() {
+			continue
+		}
+
+		err := replica.send(msg)
+
+		if err != nil {
+			return EngineErrorf3(ERR_REPLICATE, err, replica.raddr, "Error replicating to %s.", replica.raddr)
+		}
+	}
+
+	return nil
+}
+
+// Applies a write locally and replicates it. Synchronous replicas
+// get the write before it is applied locally, asynchronous replicas
+// get it queued afterwards. prepare runs under the write lock first
+// and returns the message to replicate, typically an RPut carrying
+// the versions it picked. If it returns nil there is nothing to
+// write.
+func (de *DefaultEngine) write(prepare func() (Message, EngineError), apply func() StorageError) EngineError {
+	de.wmutex.Lock()
+	defer de.wmutex.Unlock()
+
+	msg, err := prepare()
+
+	if err != nil || msg == nil {
+		return err
+	}
+
+	de.mutex.RLock()
+	replicas := de.replicas
+	de.mutex.RUnlock()
+
+	for _, replica := range replicas {
+		if replica.queueing() && replica.full() {
+			replica.overflow()
 		}
+	}
+
+	err = de.Replicate(msg)
+
+	if err != nil {
+		return err
+	}
+
+	serr := apply()
+
+	if serr != nil {
+		return EngineErrorf2(ERR_STORAGE, serr, "Storage error.")
+	}
+
+	for _, replica := range replicas {
+		if replica.queueing() {
+			replica.enqueue(msg)
+		}
+	}
+
+	return nil
+}
+
+// Checks keys and values against the configured limits.
+func (de *DefaultEngine) checkLimits(msg Message) EngineError {
+	keys, values, _, _ := requestKeys(msg)
+
+	if values != nil && len(values) != len(keys) {
+		return EngineErrorf(ERR_INTERNAL, "%d keys but %d values.", len(keys), len(values))
+	}
+
+	for _, key := range keys {
+		if len(key) > de.config.MaxKeySize {
+			return EngineErrorf(ERR_TOOLARGE, "Key too large (%d bytes).", len(key))
+		}
+	}
+
+	for _, value := range values {
+		if len(value) > de.config.MaxValueSize {
+			return EngineErrorf(ERR_TOOLARGE, "Value too large (%d bytes).", len(value))
+		}
+	}
+
+	return nil
+}
+
+func (de *DefaultEngine) ProcessMessage(msg Message) (Message, EngineError) {
+	lerr := de.checkLimits(msg)
+
+	if lerr != nil {
+		return nil, lerr
+	}
+
+	switch msg.(type) {
+	case *Limits:
+		return &Limits{
+			MId: msg.Id(),
+			MaxKeySize: uint32(de.config.MaxKeySize),
+			MaxValueSize: uint32(de.config.MaxValueSize),
+			MaxFrameSize: uint32(de.config.MaxFrameSize),
+		}, nil
+	case *Put:
+		putMsg := msg.(*Put)
+
+		key := putMsg.Key
+		value := putMsg.Value
+
+		var rputMsg *RPut
+
+		err := de.write(func() (Message, EngineError) {
+			var perr EngineError
+			rputMsg, perr = de.nextVersions([][]byte{key}, [][]byte{value}, time.Time{})
+			return rputMsg, perr
+		}, func() StorageError {
+			return de.storage.PutEntry(key, rputMsg.entry(0))
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		de.cache.remove(key)
 
 		return &Status{MId: putMsg.MId, StatusCode: 0}, nil
+	case *PutTTL:
+		putttlMsg := msg.(*PutTTL)
+
+		key := putttlMsg.Key
+		value := putttlMsg.Value
+		expires := time.Time{}
+
+		if putttlMsg.TTL > uint64(MAX_TTL / time.Millisecond) {
+			return nil, EngineErrorf(ERR_TOOLARGE, "TTL too large (%d ms).", putttlMsg.TTL)
+		}
+
+		if putttlMsg.TTL != 0 {
+			expires = time.Now().Add(time.Duration(putttlMsg.TTL) * time.Millisecond)
+		}
+
+		var rputMsg *RPut
+
+		err := de.write(func() (Message, EngineError) {
+			var perr EngineError
+			rputMsg, perr = de.nextVersions([][]byte{key}, [][]byte{value}, expires)
+			return rputMsg, perr
+		}, func() StorageError {
+			return de.storage.PutEntry(key, rputMsg.entry(0))
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		de.cache.remove(key)
+
+		return &Status{MId: putttlMsg.MId, StatusCode: 0}, nil
+	case *CAS:
+		casMsg := msg.(*CAS)
+
+		var rputMsg *RPut
+
+		err := de.write(func() (Message, EngineError) {
+			current, serr := de.storage.GetEntry(casMsg.Key)
+
+			if serr != nil {
+				return nil, EngineErrorf2(ERR_STORAGE, serr, "Storage error.")
+			}
+
+			version := uint64(0)
+
+			// An expired entry counts as gone.
+			if current != nil && !current.Expired(time.Now()) {
+				version = current.Version
+			}
+
+			if version != casMsg.Version {
+				return nil, EngineErrorf(ERR_CONFLICT, "Entry is at version %d, not %d.", version, casMsg.Version)
+			}
+
+			var perr EngineError
+			rputMsg, perr = de.nextVersions([][]byte{casMsg.Key}, [][]byte{casMsg.Value}, time.Time{})
+			return rputMsg, perr
+		}, func() StorageError {
+			return de.storage.PutEntry(casMsg.Key, rputMsg.entry(0))
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		de.cache.remove(casMsg.Key)
+
+		return &VResult{MId: casMsg.MId, Version: rputMsg.Versions[0]}, nil
+	case *Incr:
+		incrMsg := msg.(*Incr)
+
+		var rputMsg *RPut
+
+		err := de.write(func() (Message, EngineError) {
+			current, serr := de.storage.GetEntry(incrMsg.Key)
+
+			if serr != nil {
+				return nil, EngineErrorf2(ERR_STORAGE, serr, "Storage error.")
+			}
+
+			value := int64(0)
+			expires := time.Time{}
+
+			if current != nil && !current.Expired(time.Now()) {
+				var perr error
+				value, perr = strconv.ParseInt(string(current.Value), 10, 64)
+
+				if perr != nil {
+					return nil, EngineErrorf2(ERR_NOTINTEGER, perr, "Entry does not hold an integer.")
+				}
+
+				expires = current.Expires
+			}
+
+			if (incrMsg.Delta > 0 && value > math.MaxInt64 - incrMsg.Delta) || (incrMsg.Delta < 0 && value < math.MinInt64 - incrMsg.Delta) {
+				return nil, EngineErrorf(ERR_OVERFLOW, "%d + %d overflows.", value, incrMsg.Delta)
+			}
+
+			newValue := []byte(strconv.FormatInt(value + incrMsg.Delta, 10))
+
+			var perr EngineError
+			rputMsg, perr = de.nextVersions([][]byte{incrMsg.Key}, [][]byte{newValue}, expires)
+			return rputMsg, perr
+		}, func() StorageError {
+			return de.storage.PutEntry(incrMsg.Key, rputMsg.entry(0))
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		de.cache.remove(incrMsg.Key)
+
+		return &VResult{MId: incrMsg.MId, Version: rputMsg.Versions[0], Data: rputMsg.Values[0]}, nil
+	case *RPut:
+		rputMsg := msg.(*RPut)
+
+		// Only the master may pick versions for a replica.
+		if de.config.Role != ROLE_REPLICA {
+			return nil, EngineErrorf(ERR_UNSUPPORTED, "Only replicas accept RPut.")
+		}
+
+		if len(rputMsg.Versions) != len(rputMsg.Keys) || len(rputMsg.Expires) != len(rputMsg.Keys) {
+			return nil, EngineErrorf(ERR_INTERNAL, "%d keys but %d versions and %d expiry times.", len(rputMsg.Keys), len(rputMsg.Versions), len(rputMsg.Expires))
+		}
+
+		statuses := make([]uint8, len(rputMsg.Keys))
+
+		err := de.write(func() (Message, EngineError) {
+			return rputMsg, nil
+		}, func() StorageError {
+			for i, key := range rputMsg.Keys {
+				serr := de.storage.PutEntry(key, rputMsg.entry(i))
+
+				if serr != nil {
+					de.logger.Outf(LOGLVL_ERROR, "[ENGINE] ERROR: %s", serr.Error())
+					statuses[i] = ERR_STORAGE
+				}
+
+				if de.snapshotKeys != nil {
+					de.snapshotKeys[string(key)] = struct{}{}
+				}
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, key := range rputMsg.Keys {
+			de.cache.remove(key)
+		}
+
+		return &MResult{MId: rputMsg.MId, Statuses: statuses}, nil
+	case *Delete:
+		deleteMsg := msg.(*Delete)
+
+		err := de.write(func() (Message, EngineError) {
+			return deleteMsg, nil
+		}, func() StorageError {
+			return de.storage.Delete(deleteMsg.Key)
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		de.cache.remove(deleteMsg.Key)
+
+		return &Status{MId: deleteMsg.MId, StatusCode: 0}, nil
 	case *Get:
 		getMsg := msg.(*Get)
 
-		key := getMsg.Key
+		entry, err := de.get(getMsg)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if entry == nil {
+			return &Status{MId: getMsg.MId, StatusCode: ERR_NOTEXISTS}, nil
+		}
+
+		return &VResult{MId: getMsg.MId, Version: entry.Version, Data: entry.Value}, nil
+	case *LGet:
+		lgetMsg := msg.(*LGet)
 
-		dataLocal, serr := de.storage.Get(key)
+		entry, serr := de.storage.GetEntry(lgetMsg.Key)
 
 		if serr != nil {
 			return nil, EngineErrorf2(ERR_STORAGE, serr, "Storage error.")
 		}
 
-		if dataLocal == nil {
-			dataRemote, err := de.Lookup(getMsg)
+		if entry == nil || entry.Expired(time.Now()) {
+			return &Status{MId: lgetMsg.MId, StatusCode: ERR_NOTEXISTS}, nil
+		}
+
+		return &VResult{MId: lgetMsg.MId, Version: entry.Version, Data: entry.Value}, nil
+	case *MGet:
+		mgetMsg := msg.(*MGet)
+
+		resultMsg := &MResult{
+			MId: mgetMsg.MId,
+			Statuses: make([]uint8, len(mgetMsg.Keys)),
+			Values: make([][]byte, len(mgetMsg.Keys)),
+		}
+
+		for i, key := range mgetMsg.Keys {
+			entry, err := de.get(&Get{MId: mgetMsg.MId, Key: key})
 
 			if err != nil {
-				return nil, err
+				de.logger.Outf(LOGLVL_ERROR, "[ENGINE] ERROR: %s", err.Error())
+				resultMsg.Statuses[i] = err.ErrCode()
+			} else if entry == nil {
+				resultMsg.Statuses[i] = ERR_NOTEXISTS
+			} else {
+				resultMsg.Values[i] = entry.Value
 			}
+		}
 
-			if dataRemote == nil {
-				return &Status{MId: getMsg.MId, StatusCode: ERR_NOTEXISTS}, nil
-			} else {
-				return &Result{MId: getMsg.MId, Data: dataRemote}, nil
+		return resultMsg, nil
+	case *Scan:
+		return de.scan(msg.(*Scan))
+	case *Snapshot:
+		return de.snapshot(msg.(*Snapshot))
+	case *MPut:
+		mputMsg := msg.(*MPut)
+
+		statuses := make([]uint8, len(mputMsg.Keys))
+
+		var rputMsg *RPut
+
+		// The batch is replicated as a whole even if some of
+		// its entries can't be stored locally.
+		err := de.write(func() (Message, EngineError) {
+			var perr EngineError
+			rputMsg, perr = de.nextVersions(mputMsg.Keys, mputMsg.Values, time.Time{})
+			return rputMsg, perr
+		}, func() StorageError {
+			for i, key := range mputMsg.Keys {
+				serr := de.storage.PutEntry(key, rputMsg.entry(i))
+
+				if serr != nil {
+					de.logger.Outf(LOGLVL_ERROR, "[ENGINE] ERROR: %s", serr.Error())
+					statuses[i] = ERR_STORAGE
+				}
 			}
-		} else {
-			return &Result{MId: getMsg.MId, Data: dataLocal}, nil
+
+			return nil
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, key := range mputMsg.Keys {
+			de.cache.remove(key)
 		}
+
+		return &MResult{MId: mputMsg.MId, Statuses: statuses}, nil
 	}
 
 	return nil, EngineErrorf(ERR_INTERNAL, "Unknown message type.")
 }
+
+// Starts remembering the keys received from the master or deletes
+// all keys not received since the snapshot began. A snapshot cut
+// short by a lost connection is simply begun again.
+func (de *DefaultEngine) snapshot(snapshotMsg *Snapshot) (Message, EngineError) {
+	// Would let anybody delete everything on a master.
+	if de.config.Role != ROLE_REPLICA {
+		return nil, EngineErrorf(ERR_UNSUPPORTED, "Only replicas accept Snapshot.")
+	}
+
+	if snapshotMsg.Phase == SNAPSHOT_BEGIN {
+		de.wmutex.Lock()
+		de.snapshotKeys = make(map[string]struct{})
+		de.wmutex.Unlock()
+
+		return &Status{MId: snapshotMsg.MId, StatusCode: 0}, nil
+	}
+
+	if snapshotMsg.Phase != SNAPSHOT_END {
+		return nil, EngineErrorf(ERR_UNSUPPORTED, "Unknown snapshot phase %d.", snapshotMsg.Phase)
+	}
+
+	de.wmutex.Lock()
+	received := de.snapshotKeys
+	de.snapshotKeys = nil
+	de.wmutex.Unlock()
+
+	if received == nil {
+		return nil, EngineErrorf(ERR_INTERNAL, "No snapshot begun.")
+	}
+
+	var stale [][]byte
+
+	serr := de.storage.ForEach(func(key []byte, entry *Entry) bool {
+		_, ok := received[string(key)]
+
+		if !ok {
+			stale = append(stale, append([]byte(nil), key...))
+		}
+
+		return true
+	})
+
+	if serr != nil {
+		return nil, EngineErrorf2(ERR_STORAGE, serr, "Storage error.")
+	}
+
+	// Replicas of this replica need to drop them as well.
+	for _, key := range stale {
+		deleteMsg := &Delete{Key: key}
+
+		err := de.write(func() (Message, EngineError) {
+			return deleteMsg, nil
+		}, func() StorageError {
+			return de.storage.Delete(deleteMsg.Key)
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		de.cache.remove(key)
+	}
+
+	if len(stale) != 0 {
+		de.logger.Outf(LOGLVL_INFO, "[ENGINE] dropped %d entries not in the snapshot", len(stale))
+	}
+
+	return &Status{MId: snapshotMsg.MId, StatusCode: 0}, nil
+}
+
+// Versions come from a single counter for all keys, so a key deleted
+// and written again doesn't get a version a client may still hold
+// from before. The counter never falls behind the clock in
+// nanoseconds, which keeps it ahead of versions handed out before a
+// restart. Must be called with the write lock held.
+func (de *DefaultEngine) nextVersion(current *Entry) uint64 {
+	de.version++
+
+	now := uint64(time.Now().UnixNano())
+
+	if de.version < now {
+		de.version = now
+	}
+
+	if current != nil && de.version <= current.Version {
+		de.version = current.Version + 1
+	}
+
+	return de.version
+}
+
+// The RPut storing values under new versions, all expiring at
+// expires. Must be called with the write lock held.
+func (de *DefaultEngine) nextVersions(keys [][]byte, values [][]byte, expires time.Time) (*RPut, EngineError) {
+	rputMsg := &RPut{
+		Keys: keys,
+		Values: values,
+		Versions: make([]uint64, len(keys)),
+		Expires: make([]time.Time, len(keys)),
+	}
+
+	for i, key := range keys {
+		rputMsg.Expires[i] = expires
+
+		current, serr := de.storage.GetEntry(key)
+
+		if serr != nil {
+			return nil, EngineErrorf2(ERR_STORAGE, serr, "Storage error.")
+		}
+
+		// Later occurrences of a key in the same batch get
+		// higher versions as well.
+		rputMsg.Versions[i] = de.nextVersion(current)
+	}
+
+	return rputMsg, nil
+}
+
+// Looks for the key locally, then on the lookup servers. Returns nil
+// without error if nobody has it. Entries found on a lookup server
+// are at version zero.
+func (de *DefaultEngine) get(getMsg *Get) (*Entry, EngineError) {
+	entry, serr := de.storage.GetEntry(getMsg.Key)
+
+	if serr != nil {
+		return nil, EngineErrorf2(ERR_STORAGE, serr, "Storage error.")
+	}
+
+	if entry != nil && !entry.Expired(time.Now()) {
+		return entry, nil
+	}
+
+	data, err := de.Lookup(getMsg)
+
+	if data == nil {
+		return nil, err
+	}
+
+	return &Entry{Value: data}, nil
+}
@@ -0,0 +1,418 @@
+package mydb_test
+
+import (
+	. "github.com/FMNSSun/mydb"
+	"github.com/FMNSSun/mydb/storage"
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+
+	return l.Addr().String()
+}
+
+// Lets the engine serve, over TLS if config is set, and waits until it
+// accepts connections.
+func serve(t *testing.T, engine Engine, config *tls.Config) string {
+	addr := freeAddr(t)
+
+	if config != nil {
+		go engine.ServeTLS(addr, config)
+	} else {
+		go engine.Serve(addr)
+	}
+
+	for i := 0; i < 100; i++ {
+		conn, err := net.Dial("tcp", addr)
+
+		if err == nil {
+			conn.Close()
+			return addr
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("engine did not start listening on %s", addr)
+	return ""
+}
+
+func newTestEngine(config *EngineConfig) (Engine, Storage) {
+	logger := NewLogger(io.Discard, "")
+	s := storage.NewMemoryStorage(logger)
+
+	return NewEngineWithConfig(s, logger, config), s
+}
+
+func connect(t *testing.T, addr string) *Client {
+	client, err := NewClient(addr)
+
+	if err != nil {
+		t.Fatalf("connect: %s", err.Error())
+	}
+
+	return client
+}
+
+func TestMutualLookup(t *testing.T) {
+	config := &EngineConfig{LookupTimeout: 300 * time.Millisecond}
+
+	siteA, _ := newTestEngine(config)
+	defer siteA.Close()
+
+	siteB, storageB := newTestEngine(config)
+	defer siteB.Close()
+
+	addrA := serve(t, siteA, nil)
+	addrB := serve(t, siteB, nil)
+
+	err := siteA.AddLookup(addrB, LKUPMODE_DEFAULT)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = siteB.AddLookup(addrA, LKUPMODE_DEFAULT)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storageB.Put([]byte("remote"), []byte("value"))
+
+	client := connect(t, addrA)
+	defer client.Close()
+
+	value, cerr := client.Get([]byte("remote"))
+
+	if cerr != nil || !bytes.Equal(value, []byte("value")) {
+		t.Fatalf("get remote: %q %v", value, cerr)
+	}
+
+	start := time.Now()
+
+	_, cerr = client.Get([]byte("missing"))
+
+	if cerr == nil || cerr.ServerCode() != ERR_NOTEXISTS {
+		t.Fatalf("expected ERR_NOTEXISTS, got %v", cerr)
+	}
+
+	if time.Since(start) >= config.LookupTimeout {
+		t.Fatalf("miss took %s, the lookup went in circles", time.Since(start))
+	}
+}
+
+// Waits for fn to return true.
+func eventually(t *testing.T, what string, fn func() bool) {
+	t.Helper()
+
+	for i := 0; i < 200; i++ {
+		if fn() {
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+func TestReplicaBootstrap(t *testing.T) {
+	acl := NewACL(&User{Name: "master", Token: "secret", Grants: []Grant{{Prefix: []byte{}, Perms: PERM_READ | PERM_REPLICATE}}})
+
+	replica, replicaStorage := newTestEngine(&EngineConfig{Role: ROLE_REPLICA, ACL: acl})
+	defer replica.Close()
+
+	master, masterStorage := newTestEngine(&EngineConfig{PeerUser: "master", PeerToken: "secret"})
+	defer master.Close()
+
+	replicaAddr := serve(t, replica, nil)
+
+	// Left over from before the replica lost touch with the master.
+	replicaStorage.Put([]byte("stale"), []byte("old"))
+	replicaStorage.Put([]byte("both"), []byte("old"))
+
+	masterStorage.Put([]byte("both"), []byte("new"))
+	masterStorage.PutEntry([]byte("versioned"), &Entry{Value: []byte("value"), Version: 42})
+
+	err := master.AddReplica(replicaAddr, REPLMODE_ASYNC)
+
+	if err != nil {
+		t.Fatalf("add replica: %s", err.Error())
+	}
+
+	eventually(t, "the snapshot", func() bool {
+		stale, _ := replicaStorage.Get([]byte("stale"))
+		both, _ := replicaStorage.Get([]byte("both"))
+		versioned, _ := replicaStorage.GetEntry([]byte("versioned"))
+
+		return stale == nil && bytes.Equal(both, []byte("new")) && versioned != nil && versioned.Version == 42
+	})
+}
+
+// Sends msg without Hello and returns the status code of the answer.
+func rawStatus(t *testing.T, mconn MessageConn, msg Message) uint8 {
+	t.Helper()
+
+	err := mconn.SendMessage(msg)
+
+	if err != nil {
+		t.Fatalf("send: %s", err.Error())
+	}
+
+	retMsg, err := mconn.ReadMessage()
+
+	if err != nil {
+		t.Fatalf("read: %s", err.Error())
+	}
+
+	statusMsg, ok := retMsg.(*Status)
+
+	if !ok {
+		t.Fatalf("expected a Status, got %s", retMsg)
+	}
+
+	return statusMsg.StatusCode
+}
+
+func TestMasterRejectsReplication(t *testing.T) {
+	master, masterStorage := newTestEngine(&EngineConfig{})
+	defer master.Close()
+
+	addr := serve(t, master, nil)
+
+	masterStorage.Put([]byte("key"), []byte("value"))
+
+	mconn, err := DialMessageConn(addr)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer mconn.Close()
+
+	code := rawStatus(t, mconn, &Snapshot{MId: 1, Phase: SNAPSHOT_BEGIN})
+
+	if code != ERR_UNSUPPORTED {
+		t.Fatalf("snapshot begin: expected %d, got %d", ERR_UNSUPPORTED, code)
+	}
+
+	code = rawStatus(t, mconn, &Snapshot{MId: 2, Phase: SNAPSHOT_END})
+
+	if code != ERR_UNSUPPORTED {
+		t.Fatalf("snapshot end: expected %d, got %d", ERR_UNSUPPORTED, code)
+	}
+
+	code = rawStatus(t, mconn, &RPut{MId: 3, Keys: [][]byte{[]byte("key")}, Values: [][]byte{[]byte("other")}, Versions: []uint64{1}, Expires: []time.Time{time.Time{}}})
+
+	if code != ERR_UNSUPPORTED {
+		t.Fatalf("rput: expected %d, got %d", ERR_UNSUPPORTED, code)
+	}
+
+	value, _ := masterStorage.Get([]byte("key"))
+
+	if !bytes.Equal(value, []byte("value")) {
+		t.Fatalf("expected the entry to survive, got %q", value)
+	}
+}
+
+func TestReplicateToMaster(t *testing.T) {
+	// Servers not running as replica are still written to, just
+	// without versions.
+	target, targetStorage := newTestEngine(&EngineConfig{})
+	defer target.Close()
+
+	master, _ := newTestEngine(&EngineConfig{})
+	defer master.Close()
+
+	targetAddr := serve(t, target, nil)
+	masterAddr := serve(t, master, nil)
+
+	err := master.AddReplica(targetAddr, REPLMODE_SYNC)
+
+	if err != nil {
+		t.Fatalf("add replica: %s", err.Error())
+	}
+
+	client := connect(t, masterAddr)
+	defer client.Close()
+
+	cerr := client.Put([]byte("key"), []byte("value"))
+
+	if cerr != nil {
+		t.Fatalf("put: %s", cerr.Error())
+	}
+
+	eventually(t, "the write", func() bool {
+		value, _ := targetStorage.Get([]byte("key"))
+		return bytes.Equal(value, []byte("value"))
+	})
+}
+
+// A replica that speaks protocol version 0 and acknowledges every
+// write, or none while stalled.
+func fakeReplica(t *testing.T, stalled *atomic.Bool, conns *atomic.Int32) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+
+			if err != nil {
+				return
+			}
+
+			conns.Add(1)
+
+			go func() {
+				mconn := NewMessageConn(conn)
+				defer mconn.Close()
+
+				for {
+					msg, err := mconn.ReadMessage()
+
+					if err != nil {
+						return
+					}
+
+					if _, ok := msg.(*Hello); ok {
+						mconn.SendMessage(&Status{MId: msg.Id(), StatusCode: ERR_UNSUPPORTED})
+					} else if !stalled.Load() {
+						mconn.SendMessage(&Status{MId: msg.Id()})
+					}
+				}
+			}()
+		}
+	}()
+
+	return l
+}
+
+func TestStalledReplica(t *testing.T) {
+	var stalled atomic.Bool
+	var conns atomic.Int32
+
+	l := fakeReplica(t, &stalled, &conns)
+	defer l.Close()
+
+	master, _ := newTestEngine(&EngineConfig{
+		PeerTimeout: 200 * time.Millisecond,
+		ReconnectMin: 10 * time.Millisecond,
+	})
+	defer master.Close()
+
+	addr := serve(t, master, nil)
+
+	err := master.AddReplica(l.Addr().String(), REPLMODE_SYNC)
+
+	if err != nil {
+		t.Fatalf("add replica: %s", err.Error())
+	}
+
+	eventually(t, "snapshot to go through", func() bool {
+		return !master.Stats().Replicas[0].Bootstrapping
+	})
+
+	client := connect(t, addr)
+	defer client.Close()
+
+	stalled.Store(true)
+
+	start := time.Now()
+
+	cerr := client.Put([]byte("key"), []byte("value"))
+
+	if cerr == nil {
+		t.Fatalf("put succeeded although the replica didn't answer")
+	}
+
+	if time.Since(start) > 2 * time.Second {
+		t.Fatalf("put waited for the replica for %s", time.Since(start))
+	}
+
+	eventually(t, "master to connect again", func() bool {
+		return conns.Load() > 1
+	})
+
+	stalled.Store(false)
+
+	eventually(t, "writes to go through again", func() bool {
+		return client.Put([]byte("key"), []byte("value")) == nil
+	})
+}
+
+func TestSlowMessageWithoutReadTimeout(t *testing.T) {
+	engine, _ := newTestEngine(&EngineConfig{IdleTimeout: 200 * time.Millisecond})
+	defer engine.Close()
+
+	addr := serve(t, engine, nil)
+
+	conn, err := net.Dial("tcp", addr)
+
+	if err != nil {
+		t.Fatalf("dial: %s", err.Error())
+	}
+
+	defer conn.Close()
+
+	var buf bytes.Buffer
+
+	err = WriteMessage(&buf, &Put{MId: 1, Key: []byte("key"), Value: []byte("value")})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frame := buf.Bytes()
+
+	// The first byte starts the message, the rest arrives after
+	// the idle timeout passed.
+	_, err = conn.Write(frame[:1])
+
+	if err != nil {
+		t.Fatalf("write: %s", err.Error())
+	}
+
+	time.Sleep(400 * time.Millisecond)
+
+	_, err = conn.Write(frame[1:])
+
+	if err != nil {
+		t.Fatalf("write: %s", err.Error())
+	}
+
+	mconn := NewMessageConn(conn)
+
+	retMsg, err := mconn.ReadMessage()
+
+	if err != nil {
+		t.Fatalf("read: %s", err.Error())
+	}
+
+	statusMsg, ok := retMsg.(*Status)
+
+	if !ok || statusMsg.StatusCode != 0 {
+		t.Fatalf("expected a successful Status, got %s", retMsg)
+	}
+
+	if engine.Stats().TimedOut != 0 {
+		t.Fatalf("message counted as timed out")
+	}
+}
@@ -0,0 +1,102 @@
+package mydb
+
+import (
+	"time"
+)
+
+// Periodically deletes expired entries until the engine shuts down.
+func (de *DefaultEngine) sweepLoop() {
+	defer de.sweepWg.Done()
+
+	ticker := time.NewTicker(de.config.ExpiryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			de.sweep()
+		case <-de.done:
+			return
+		}
+	}
+}
+
+// Deletes the entries that expired. The deletes are replicated like
+// any other, replicas hide expired entries on their own until then.
+func (de *DefaultEngine) sweep() {
+	now := time.Now()
+	expired := make([][]byte, 0)
+
+	var serr StorageError
+
+	estorage, ok := de.storage.(ExpiringStorage)
+
+	if ok {
+		serr = estorage.ForEachExpiring(func(key []byte, expires time.Time) bool {
+			if !now.Before(expires) {
+				expired = append(expired, key)
+			}
+
+			return !de.isClosing()
+		})
+	} else {
+		// Reads every value, fine for small storages only.
+		serr = de.storage.ForEach(func(key []byte, entry *Entry) bool {
+			if entry.Expired(now) {
+				expired = append(expired, key)
+			}
+
+			return !de.isClosing()
+		})
+	}
+
+	if serr != nil {
+		de.logger.Outf(LOGLVL_ERROR, "[ENGINE] ERROR: expiry: %s", serr.Error())
+		return
+	}
+
+	for _, key := range expired {
+		if de.isClosing() {
+			return
+		}
+
+		deleted := false
+
+		err := de.write(func() (Message, EngineError) {
+			entry, serr := de.storage.GetEntry(key)
+
+			if serr != nil {
+				return nil, EngineErrorf2(ERR_STORAGE, serr, "Storage error.")
+			}
+
+			// Written again in the meantime.
+			if entry == nil || !entry.Expired(time.Now()) {
+				return nil, nil
+			}
+
+			deleted = true
+
+			return &Delete{Key: key}, nil
+		}, func() StorageError {
+			return de.storage.Delete(key)
+		})
+
+		if err != nil {
+			// Tried again on the next sweep.
+			de.logger.Outf(LOGLVL_ERROR, "[ENGINE] ERROR: expiry: %s", err.Error())
+			continue
+		}
+
+		if deleted {
+			de.cache.remove(key)
+
+			de.connMutex.Lock()
+			de.expired++
+			de.connMutex.Unlock()
+		}
+	}
+
+	if len(expired) > 0 {
+		de.logger.Outf(LOGLVL_INFO, "[ENGINE] expired %d entries", len(expired))
+	}
+}
@@ -0,0 +1,135 @@
+package mydb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Highest protocol version spoken. Peers that don't send a Hello
+// speak version 0.
+const PROTOCOL_VERSION = uint16(1)
+
+// Understands Delete messages.
+const CAP_DELETE = uint32(0x00000001)
+
+// Redirects writes to a read-only replica to its master.
+const CAP_REDIRECT = uint32(0x00000002)
+
+// Answers Limits messages.
+const CAP_LIMITS = uint32(0x00000004)
+
+// Reports errors with an Error message instead of a Status.
+const CAP_ERRDETAIL = uint32(0x00000008)
+
+// Understands MGet and MPut messages.
+const CAP_BATCH = uint32(0x00000010)
+
+// Understands CAS and RPut messages and answers Gets with a VResult.
+const CAP_VERSIONS = uint32(0x00000020)
+
+// Understands PutTTL messages.
+const CAP_TTL = uint32(0x00000040)
+
+// Understands Incr messages.
+const CAP_COUNTERS = uint32(0x00000080)
+
+// Understands Scan messages.
+const CAP_SCAN = uint32(0x00000100)
+
+// Understands Snapshot messages and thus drops entries a snapshot
+// doesn't contain.
+const CAP_SNAPSHOT = uint32(0x00000200)
+
+// Understands LGet messages.
+const CAP_LGET = uint32(0x00000400)
+
+// Everything this version supports.
+const CAPS_SUPPORTED = CAP_DELETE | CAP_REDIRECT | CAP_LIMITS | CAP_ERRDETAIL | CAP_BATCH | CAP_VERSIONS | CAP_TTL | CAP_COUNTERS | CAP_SCAN | CAP_SNAPSHOT | CAP_LGET
+
+// Returned when sending a message the other side did not agree to.
+var ErrUnsupported = errors.New("Not supported by the server.")
+
+// The capability needed to send msg, zero if none is.
+func requiredCap(msg Message) uint32 {
+	switch msg.(type) {
+	case *Delete:
+		return CAP_DELETE
+	case *Limits:
+		return CAP_LIMITS
+	case *MGet, *MPut:
+		return CAP_BATCH
+	case *CAS, *RPut:
+		return CAP_VERSIONS
+	case *PutTTL:
+		return CAP_TTL
+	case *Incr:
+		return CAP_COUNTERS
+	case *Scan:
+		return CAP_SCAN
+	case *Snapshot:
+		return CAP_SNAPSHOT
+	case *LGet:
+		return CAP_LGET
+	}
+
+	return 0
+}
+
+// The status code of a Status or Error response.
+func statusCode(msg Message) (uint8, bool) {
+	switch msg.(type) {
+	case *Status:
+		return msg.(*Status).StatusCode, true
+	case *Error:
+		return msg.(*Error).Code, true
+	}
+
+	return 0, false
+}
+
+// What both sides support given the client's Hello.
+func negotiate(helloMsg *Hello) *Hello {
+	version := helloMsg.Version
+
+	if version > PROTOCOL_VERSION {
+		version = PROTOCOL_VERSION
+	}
+
+	return &Hello{
+		MId: helloMsg.MId,
+		Version: version,
+		Caps: helloMsg.Caps & CAPS_SUPPORTED,
+	}
+}
+
+// Sends a Hello over a fresh connection and remembers what was
+// agreed on.
+func hello(ctx context.Context, pipe *pipeline) error {
+	msg, err := pipe.roundTripContext(ctx, &Hello{
+		Version: PROTOCOL_VERSION,
+		Caps: CAPS_SUPPORTED,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	statusMsg, ok := msg.(*Status)
+
+	if ok && statusMsg.StatusCode == ERR_UNSUPPORTED {
+		// Speaks version 0 only.
+		pipe.setCaps(0, 0)
+		return nil
+	}
+
+	helloMsg, ok := msg.(*Hello)
+
+	if !ok {
+		return fmt.Errorf("Server responded with wrong message type.")
+	}
+
+	pipe.setCaps(helloMsg.Version, helloMsg.Caps & CAPS_SUPPORTED)
+
+	return nil
+}
@@ -1,8 +1,11 @@
 package mydb
 
 import (
+	"context"
 	"crypto/sha1"
+	"crypto/tls"
 	"fmt"
+	"time"
 )
 
 type Logger interface {
@@ -30,11 +33,28 @@ const LKUPMODE_DEFAULT = uint8(0x04)
 // Ask all servers at the same time. 
 const LKUPMODE_PARALLEL = uint8(0x08)
 
+// Acknowledge a write only after the replica has it.
+const REPLMODE_SYNC = uint8(0x01)
+
+// Acknowledge a write after the local write and replicate
+// it in the background.
+const REPLMODE_ASYNC = uint8(0x02)
+
+// Accepts writes from clients and replicates them.
+const ROLE_MASTER = uint8(0x01)
+
+// Read-only for clients. Writes only arrive from the master.
+const ROLE_REPLICA = uint8(0x02)
+
 type MessageConn interface {
 	SendMessage(msg Message) error
 	ReadMessage() (Message, error)
 	Begin()
 	End()
+	Close() error
+	// A zero time means no deadline.
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
 }
 
 type KeyHash [20]byte
@@ -45,29 +65,115 @@ func Hash(key []byte) KeyHash {
 
 type Engine interface {
 	Serve(laddr string) error
-	AddReplica(raddr string) error
-	AddLookup(raddr string) error
+	ServeTLS(laddr string, config *tls.Config) error
+	AddReplica(raddr string, mode uint8) error
+	AddLookup(raddr string, mode uint8) error
+	Stats() *EngineStats
+	Shutdown(ctx context.Context) error
+	Close() error
+}
+
+// A stored value and its version. Versions grow with every write of
+// the key. The engine doesn't reuse them after a delete either.
+type Entry struct {
+	Value []byte
+	Version uint64
+	// Zero if the entry never expires.
+	Expires time.Time
+}
+
+func (e *Entry) Expired(now time.Time) bool {
+	return !e.Expires.IsZero() && !now.Before(e.Expires)
 }
 
 type Storage interface {
+	// Stores the value at the version following the current one
+	// without expiry.
 	Put(key []byte, value []byte) StorageError
+	// Nil without error if the entry does not exist or expired.
 	Get(key []byte) ([]byte, StorageError)
+	// Like Get but with version and expiry. Expired entries are
+	// returned as well until they are deleted.
+	GetEntry(key []byte) (*Entry, StorageError)
+	// Stores the entry at the version and with the expiry it carries.
+	PutEntry(key []byte, entry *Entry) StorageError
+	// Removes the entry. Deleting a key that does not exist is not an error.
+	Delete(key []byte) StorageError
+	// Calls fn for every entry until it returns false. Writes made
+	// while iterating may or may not be seen.
+	ForEach(fn func(key []byte, entry *Entry) bool) StorageError
+	Close() StorageError
+}
+
+// Walks the entries of an OrderedStorage in key order. Writes made
+// while iterating may or may not be seen.
+type Iterator interface {
+	// The next call to Next moves to the first key not less than key.
+	Seek(key []byte)
+	// Moves to the next entry. Returns false if there is none. Has to
+	// be called before the first entry can be accessed.
+	Next() bool
+	Key() []byte
+	// Expired entries are returned as well.
+	Entry() *Entry
+	Close() StorageError
+}
+
+// Storage that can walk its entries in key order.
+type OrderedStorage interface {
+	Storage
+	// Starts at the smallest key.
+	NewIterator() Iterator
+}
+
+// Storage that can list the entries with an expiry time without
+// reading their values. The expiry sweeper then doesn't have to go
+// through the whole storage.
+type ExpiringStorage interface {
+	Storage
+	// Calls fn for every entry that expires until it returns false.
+	// Writes made while iterating may or may not be seen.
+	ForEachExpiring(fn func(key []byte, expires time.Time) bool) StorageError
 }
 
 type ClientError interface {
 	error
 	Cause() error
+	// Whether the request was given up on because its deadline
+	// passed rather than because the server reported an error.
+	Timeout() bool
+	// The ERR_* code the server responded with, zero if the error
+	// didn't come from the server.
+	ServerCode() uint8
+	// The replica or lookup server that failed, if the server
+	// reported one.
+	Peer() string
 }
 
 type clientError struct {
 	msg string
 	cause error
+	timeout bool
+	serverCode uint8
+	peer string
 }
 
 func (ce *clientError) Cause() error {
 	return ce.cause
 }
 
+func (ce *clientError) Timeout() bool {
+	return ce.timeout
+}
+
+func (ce *clientError) ServerCode() uint8 {
+	return ce.serverCode
+}
+
+func (ce *clientError) Peer() string {
+	return ce.peer
+}
+
 func (ce *clientError) Error() string {
 	if ce.cause != nil {
 		return fmt.Sprintf("ERR: %s (Cause: %s)", ce.msg, ce.cause.Error())
@@ -89,6 +195,8 @@ type EngineError interface {
 	ErrCode() uint8
 	Msg() string
 	Cause() error
+	// The replica or lookup server that failed, empty if none.
+	Peer() string
 }
 
 // Too much stuff going on.
@@ -109,10 +217,35 @@ const ERR_LOOKUP = uint8(0x05)
 // Entry does not exist.
 const ERR_NOTEXISTS = uint8(0xC0)
 
+// Not allowed to do this.
+const ERR_DENIED = uint8(0xC1)
+
+// Not authenticated or wrong credentials.
+const ERR_AUTH = uint8(0xC2)
+
+// Server is a read-only replica.
+const ERR_READONLY = uint8(0xC3)
+
+// Key, value or message larger than the server allows.
+const ERR_TOOLARGE = uint8(0xC4)
+
+// Message type or feature the server doesn't support.
+const ERR_UNSUPPORTED = uint8(0xC5)
+
+// Entry is not at the version a CAS expected.
+const ERR_CONFLICT = uint8(0xC6)
+
+// Entry does not hold an integer.
+const ERR_NOTINTEGER = uint8(0xC7)
+
+// Result would not fit into a signed 64 bit integer.
+const ERR_OVERFLOW = uint8(0xC8)
+
 type engineError struct {
 	errCode uint8
 	msg string
 	cause error
+	peer string
 }
 
 func (ee *engineError) ErrCode() uint8 {
@@ -127,6 +260,10 @@ func (ee *engineError) Cause() error {
 	return ee.cause
 }
 
+func (ee *engineError) Peer() string {
+	return ee.peer
+}
+
 func (ee *engineError) Error() string {
 	if ee.cause != nil {
 		return fmt.Sprintf("ERR(%d): %s (Cause: %s)", ee.errCode, ee.msg, ee.cause.Error())
@@ -143,6 +280,15 @@ func EngineErrorf2(errCode uint8, cause error, msg string, args... interface{})
 	}
 }
 
+func EngineErrorf3(errCode uint8, cause error, peer string, msg string, args... interface{}) EngineError {
+	return &engineError {
+		errCode: errCode,
+		msg: fmt.Sprintf(msg, args...),
+		cause: cause,
+		peer: peer,
+	}
+}
+
 func EngineErrorf(errCode uint8, msg string, args... interface{}) EngineError {
 	return &engineError {
 		errCode: errCode,
@@ -189,3 +335,11 @@ func StorageErrorf(errCode uint8, msg string, args... interface{}) StorageError
 		msg: fmt.Sprintf(msg, args...),
 	}
 }
+
+func StorageErrorf2(errCode uint8, cause error, msg string, args... interface{}) StorageError {
+	return &storageError {
+		errCode: errCode,
+		msg: fmt.Sprintf(msg, args...),
+		cause: cause,
+	}
+}
@@ -23,6 +23,11 @@ func NewLogger(w io.Writer, prefix string) *DefaultLogger {
 	}
 }
 
+// Messages with a level above lvl are dropped.
+func (dl *DefaultLogger) SetLevel(lvl uint8) {
+	dl.maxLvl = lvl
+}
+
 func (dl *DefaultLogger) Fatalf(msg string, args... interface{}) {
 	if dl.w == nil {
 		os.Exit(2)
@@ -52,7 +57,7 @@ func (dl *DefaultLogger) Outf(lvl uint8, msg string, args... interface{}) {
 		return
 	}
 
-	str := fmt.Sprintf(msg, args)
+	str := fmt.Sprintf(msg, args...)
 
 	dl.Out(lvl, str)
 }
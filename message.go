@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"io"
 	"bytes"
+	"time"
 )
 
 type Message interface {
@@ -82,10 +83,514 @@ func (*Put) Type() uint8 {
 	return MTYPE_PUT
 }
 
+type Delete struct {
+	MId uint32
+	Key []byte
+}
+
+func (d *Delete) String() string {
+	return fmt.Sprintf("DELETE %d %x", d.MId, d.Key)
+}
+
+func (d *Delete) Id() uint32 {
+	return d.MId
+}
+
+func (*Delete) Type() uint8 {
+	return MTYPE_DELETE
+}
+
+type Auth struct {
+	MId uint32
+	User []byte
+	Token []byte
+}
+
+func (a *Auth) String() string {
+	// Don't leak the token into logs.
+	return fmt.Sprintf("AUTH %d %s", a.MId, a.User)
+}
+
+func (a *Auth) Id() uint32 {
+	return a.MId
+}
+
+func (*Auth) Type() uint8 {
+	return MTYPE_AUTH
+}
+
+// Tells the client to send its write to the master at Addr
+// instead.
+type Redirect struct {
+	MId uint32
+	Addr []byte
+}
+
+func (r *Redirect) String() string {
+	return fmt.Sprintf("REDIRECT %d %s", r.MId, r.Addr)
+}
+
+func (r *Redirect) Id() uint32 {
+	return r.MId
+}
+
+func (*Redirect) Type() uint8 {
+	return MTYPE_REDIRECT
+}
+
+// Sent with all limits zero to ask the server for its limits, which
+// it answers with. Sizes are in bytes.
+type Limits struct {
+	MId uint32
+	MaxKeySize uint32
+	MaxValueSize uint32
+	MaxFrameSize uint32
+}
+
+func (l *Limits) String() string {
+	return fmt.Sprintf("LIMITS %d %d %d %d", l.MId, l.MaxKeySize, l.MaxValueSize, l.MaxFrameSize)
+}
+
+func (l *Limits) Id() uint32 {
+	return l.MId
+}
+
+func (*Limits) Type() uint8 {
+	return MTYPE_LIMITS
+}
+
+// First message on a connection. The client sends the highest
+// protocol version and the CAP_* flags it supports, the server
+// answers with the version and flags both sides support.
+type Hello struct {
+	MId uint32
+	Version uint16
+	Caps uint32
+}
+
+func (h *Hello) String() string {
+	return fmt.Sprintf("HELLO %d %d %x", h.MId, h.Version, h.Caps)
+}
+
+func (h *Hello) Id() uint32 {
+	return h.MId
+}
+
+func (*Hello) Type() uint8 {
+	return MTYPE_HELLO
+}
+
+// Sent instead of a Status with an error code to clients that agreed
+// on CAP_ERRDETAIL. Peer is the replica or lookup server that failed,
+// if any.
+type Error struct {
+	MId uint32
+	Code uint8
+	Msg []byte
+	Peer []byte
+}
+
+func (e *Error) String() string {
+	return fmt.Sprintf("ERROR %d %d %q %s", e.MId, e.Code, e.Msg, e.Peer)
+}
+
+func (e *Error) Id() uint32 {
+	return e.MId
+}
+
+func (*Error) Type() uint8 {
+	return MTYPE_ERROR
+}
+
+// Gets many keys at once. Answered with an MResult holding one
+// result per key in the same order.
+type MGet struct {
+	MId uint32
+	Keys [][]byte
+}
+
+func (m *MGet) String() string {
+	return fmt.Sprintf("MGET %d %d", m.MId, len(m.Keys))
+}
+
+func (m *MGet) Id() uint32 {
+	return m.MId
+}
+
+func (*MGet) Type() uint8 {
+	return MTYPE_MGET
+}
+
+// Puts many entries at once. Keys and Values have the same length.
+// Answered with an MResult holding one status per entry.
+type MPut struct {
+	MId uint32
+	Keys [][]byte
+	Values [][]byte
+}
+
+func (m *MPut) String() string {
+	return fmt.Sprintf("MPUT %d %d", m.MId, len(m.Keys))
+}
+
+func (m *MPut) Id() uint32 {
+	return m.MId
+}
+
+func (*MPut) Type() uint8 {
+	return MTYPE_MPUT
+}
+
+// Per key results of an MGet or MPut. A status of 0 means the key
+// was found or written, ERR_NOTEXISTS that it wasn't found. Values
+// holds the data found, it is empty for an MPut.
+type MResult struct {
+	MId uint32
+	Statuses []uint8
+	Values [][]byte
+}
+
+func (m *MResult) String() string {
+	return fmt.Sprintf("MRESULT %d %d", m.MId, len(m.Statuses))
+}
+
+func (m *MResult) Id() uint32 {
+	return m.MId
+}
+
+func (*MResult) Type() uint8 {
+	return MTYPE_MRESULT
+}
+
+// Puts the value only if the entry is still at Version, zero meaning
+// it must not exist. Answered with a VResult holding the new version
+// or ERR_CONFLICT.
+type CAS struct {
+	MId uint32
+	Version uint64
+	Key []byte
+	Value []byte
+}
+
+func (c *CAS) String() string {
+	return fmt.Sprintf("CAS %d %d %x %x", c.MId, c.Version, c.Key, c.Value)
+}
+
+func (c *CAS) Id() uint32 {
+	return c.MId
+}
+
+func (*CAS) Type() uint8 {
+	return MTYPE_CAS
+}
+
+// A Result with the version of the entry. Sent instead of a Result
+// to clients that agreed to CAP_VERSIONS.
+type VResult struct {
+	MId uint32
+	Version uint64
+	Data []byte
+}
+
+func (v *VResult) String() string {
+	return fmt.Sprintf("VRESULT %d %d %x", v.MId, v.Version, v.Data)
+}
+
+func (v *VResult) Id() uint32 {
+	return v.MId
+}
+
+func (*VResult) Type() uint8 {
+	return MTYPE_VRESULT
+}
+
+// Puts entries at the versions and with the expiry times the master
+// gave them. Used for replication. Answered with an MResult.
+type RPut struct {
+	MId uint32
+	Keys [][]byte
+	Values [][]byte
+	Versions []uint64
+	// Zero for entries that don't expire.
+	Expires []time.Time
+}
+
+func (r *RPut) entry(i int) *Entry {
+	return &Entry{Value: r.Values[i], Version: r.Versions[i], Expires: r.Expires[i]}
+}
+
+func (r *RPut) String() string {
+	return fmt.Sprintf("RPUT %d %d", r.MId, len(r.Keys))
+}
+
+func (r *RPut) Id() uint32 {
+	return r.MId
+}
+
+func (*RPut) Type() uint8 {
+	return MTYPE_RPUT
+}
+
+// Like Put but the entry expires after TTL milliseconds. Answered
+// like a Put.
+type PutTTL struct {
+	MId uint32
+	TTL uint64
+	Key []byte
+	Value []byte
+}
+
+func (p *PutTTL) String() string {
+	return fmt.Sprintf("PUTTTL %d %d %x %x", p.MId, p.TTL, p.Key, p.Value)
+}
+
+func (p *PutTTL) Id() uint32 {
+	return p.MId
+}
+
+func (*PutTTL) Type() uint8 {
+	return MTYPE_PUTTTL
+}
+
+// Adds Delta to the integer stored as decimal text under Key, a
+// missing entry counting as zero. Answered with a VResult holding
+// the new value.
+type Incr struct {
+	MId uint32
+	Delta int64
+	Key []byte
+}
+
+func (i *Incr) String() string {
+	return fmt.Sprintf("INCR %d %d %x", i.MId, i.Delta, i.Key)
+}
+
+func (i *Incr) Id() uint32 {
+	return i.MId
+}
+
+func (*Incr) Type() uint8 {
+	return MTYPE_INCR
+}
+
+// Asks for up to Limit entries in key order starting at Start, before
+// End and starting with Prefix. An empty End means no upper bound, a
+// zero Limit the most the server sends at once. Answered with a
+// ScanResult.
+type Scan struct {
+	MId uint32
+	Start []byte
+	End []byte
+	Prefix []byte
+	Limit uint32
+}
+
+func (s *Scan) String() string {
+	return fmt.Sprintf("SCAN %d %x %x %x %d", s.MId, s.Start, s.End, s.Prefix, s.Limit)
+}
+
+func (s *Scan) Id() uint32 {
+	return s.MId
+}
+
+func (*Scan) Type() uint8 {
+	return MTYPE_SCAN
+}
+
+// One page of a Scan. If More is set there are further entries after
+// the last key.
+type ScanResult struct {
+	MId uint32
+	More bool
+	Keys [][]byte
+	Values [][]byte
+}
+
+func (s *ScanResult) String() string {
+	return fmt.Sprintf("SCANRESULT %d %t %d", s.MId, s.More, len(s.Keys))
+}
+
+func (s *ScanResult) Id() uint32 {
+	return s.MId
+}
+
+func (*ScanResult) Type() uint8 {
+	return MTYPE_SCANRESULT
+}
+
+// Brackets the entries of a snapshot sent to a replica. At
+// SNAPSHOT_END the replica deletes every entry it didn't receive
+// since SNAPSHOT_BEGIN. Answered with a Status.
+type Snapshot struct {
+	MId uint32
+	Phase uint8
+}
+
+func (s *Snapshot) String() string {
+	return fmt.Sprintf("SNAPSHOT %d %d", s.MId, s.Phase)
+}
+
+func (s *Snapshot) Id() uint32 {
+	return s.MId
+}
+
+func (*Snapshot) Type() uint8 {
+	return MTYPE_SNAPSHOT
+}
+
+const SNAPSHOT_BEGIN = uint8(0x01)
+const SNAPSHOT_END = uint8(0x02)
+
+// Like Get but only answered from the server's own storage, never
+// from its lookup servers. Servers ask their lookup servers with it
+// so a miss doesn't go back and forth between servers that look each
+// other up.
+type LGet struct {
+	MId uint32
+	Key []byte
+}
+
+func (l *LGet) String() string {
+	return fmt.Sprintf("LGET %d %x", l.MId, l.Key)
+}
+
+func (l *LGet) Id() uint32 {
+	return l.MId
+}
+
+func (*LGet) Type() uint8 {
+	return MTYPE_LGET
+}
+
+// Returned by CreateMessage for message types it doesn't know. The
+// payload has been read, so the connection can still be used.
+type UnknownTypeError struct {
+	MId uint32
+	MType uint8
+}
+
+func (e *UnknownTypeError) Error() string {
+	return fmt.Sprintf("Unknown message type %d (r).", e.MType)
+}
+
+// Returns a copy of the message carrying the given id.
+func withId(msg Message, mid uint32) Message {
+	switch msg.(type) {
+	case *Put:
+		putMsg := *msg.(*Put)
+		putMsg.MId = mid
+		return &putMsg
+	case *Get:
+		getMsg := *msg.(*Get)
+		getMsg.MId = mid
+		return &getMsg
+	case *Status:
+		statusMsg := *msg.(*Status)
+		statusMsg.MId = mid
+		return &statusMsg
+	case *Result:
+		resultMsg := *msg.(*Result)
+		resultMsg.MId = mid
+		return &resultMsg
+	case *Delete:
+		deleteMsg := *msg.(*Delete)
+		deleteMsg.MId = mid
+		return &deleteMsg
+	case *Auth:
+		authMsg := *msg.(*Auth)
+		authMsg.MId = mid
+		return &authMsg
+	case *Redirect:
+		redirectMsg := *msg.(*Redirect)
+		redirectMsg.MId = mid
+		return &redirectMsg
+	case *Limits:
+		limitsMsg := *msg.(*Limits)
+		limitsMsg.MId = mid
+		return &limitsMsg
+	case *Hello:
+		helloMsg := *msg.(*Hello)
+		helloMsg.MId = mid
+		return &helloMsg
+	case *Error:
+		errorMsg := *msg.(*Error)
+		errorMsg.MId = mid
+		return &errorMsg
+	case *MGet:
+		mgetMsg := *msg.(*MGet)
+		mgetMsg.MId = mid
+		return &mgetMsg
+	case *MPut:
+		mputMsg := *msg.(*MPut)
+		mputMsg.MId = mid
+		return &mputMsg
+	case *MResult:
+		mresultMsg := *msg.(*MResult)
+		mresultMsg.MId = mid
+		return &mresultMsg
+	case *CAS:
+		casMsg := *msg.(*CAS)
+		casMsg.MId = mid
+		return &casMsg
+	case *VResult:
+		vresultMsg := *msg.(*VResult)
+		vresultMsg.MId = mid
+		return &vresultMsg
+	case *RPut:
+		rputMsg := *msg.(*RPut)
+		rputMsg.MId = mid
+		return &rputMsg
+	case *PutTTL:
+		putttlMsg := *msg.(*PutTTL)
+		putttlMsg.MId = mid
+		return &putttlMsg
+	case *Incr:
+		incrMsg := *msg.(*Incr)
+		incrMsg.MId = mid
+		return &incrMsg
+	case *Scan:
+		scanMsg := *msg.(*Scan)
+		scanMsg.MId = mid
+		return &scanMsg
+	case *ScanResult:
+		scanresultMsg := *msg.(*ScanResult)
+		scanresultMsg.MId = mid
+		return &scanresultMsg
+	case *Snapshot:
+		snapshotMsg := *msg.(*Snapshot)
+		snapshotMsg.MId = mid
+		return &snapshotMsg
+	case *LGet:
+		lgetMsg := *msg.(*LGet)
+		lgetMsg.MId = mid
+		return &lgetMsg
+	}
+
+	panic("BUG: withId... unknown message type!")
+}
+
 const MTYPE_PUT = uint8(0x01)
 const MTYPE_GET = uint8(0x02)
 const MTYPE_STATUS = uint8(0x03)
 const MTYPE_RESULT = uint8(0x04)
+const MTYPE_DELETE = uint8(0x05)
+const MTYPE_AUTH = uint8(0x06)
+const MTYPE_REDIRECT = uint8(0x07)
+const MTYPE_LIMITS = uint8(0x08)
+const MTYPE_HELLO = uint8(0x09)
+const MTYPE_ERROR = uint8(0x0A)
+const MTYPE_MGET = uint8(0x0B)
+const MTYPE_MPUT = uint8(0x0C)
+const MTYPE_MRESULT = uint8(0x0D)
+const MTYPE_CAS = uint8(0x0E)
+const MTYPE_VRESULT = uint8(0x0F)
+const MTYPE_RPUT = uint8(0x10)
+const MTYPE_PUTTTL = uint8(0x11)
+const MTYPE_INCR = uint8(0x12)
+const MTYPE_SCAN = uint8(0x13)
+const MTYPE_SCANRESULT = uint8(0x14)
+const MTYPE_SNAPSHOT = uint8(0x15)
+const MTYPE_LGET = uint8(0x16)
 
 func WriteMessage(w io.Writer, msg Message) error {
 	switch msg.(type) {
@@ -101,6 +606,60 @@ func WriteMessage(w io.Writer, msg Message) error {
 	case *Result:
 		resultMsg := msg.(*Result)
 		return writeResultMessage(w, resultMsg)
+	case *Delete:
+		deleteMsg := msg.(*Delete)
+		return writeDeleteMessage(w, deleteMsg)
+	case *Auth:
+		authMsg := msg.(*Auth)
+		return writeAuthMessage(w, authMsg)
+	case *Redirect:
+		redirectMsg := msg.(*Redirect)
+		return writeRedirectMessage(w, redirectMsg)
+	case *Limits:
+		limitsMsg := msg.(*Limits)
+		return writeLimitsMessage(w, limitsMsg)
+	case *Hello:
+		helloMsg := msg.(*Hello)
+		return writeHelloMessage(w, helloMsg)
+	case *Error:
+		errorMsg := msg.(*Error)
+		return writeErrorMessage(w, errorMsg)
+	case *MGet:
+		mgetMsg := msg.(*MGet)
+		return writeMGetMessage(w, mgetMsg)
+	case *MPut:
+		mputMsg := msg.(*MPut)
+		return writeMPutMessage(w, mputMsg)
+	case *MResult:
+		mresultMsg := msg.(*MResult)
+		return writeMResultMessage(w, mresultMsg)
+	case *CAS:
+		casMsg := msg.(*CAS)
+		return writeCASMessage(w, casMsg)
+	case *VResult:
+		vresultMsg := msg.(*VResult)
+		return writeVResultMessage(w, vresultMsg)
+	case *RPut:
+		rputMsg := msg.(*RPut)
+		return writeRPutMessage(w, rputMsg)
+	case *PutTTL:
+		putttlMsg := msg.(*PutTTL)
+		return writePutTTLMessage(w, putttlMsg)
+	case *Incr:
+		incrMsg := msg.(*Incr)
+		return writeIncrMessage(w, incrMsg)
+	case *Scan:
+		scanMsg := msg.(*Scan)
+		return writeScanMessage(w, scanMsg)
+	case *ScanResult:
+		scanresultMsg := msg.(*ScanResult)
+		return writeScanResultMessage(w, scanresultMsg)
+	case *Snapshot:
+		snapshotMsg := msg.(*Snapshot)
+		return writeSnapshotMessage(w, snapshotMsg)
+	case *LGet:
+		lgetMsg := msg.(*LGet)
+		return writeLGetMessage(w, lgetMsg)
 	}
 
 	return fmt.Errorf("Unknown message type (w).")
@@ -146,17 +705,18 @@ func writeGetMessage(w io.Writer, getMsg *Get) error {
 	return err
 }
 
-func writeStatusMessage(w io.Writer, statusMsg *Status) error {
+func writeDeleteMessage(w io.Writer, deleteMsg *Delete) error {
 	buf := new(bytes.Buffer)
-	payloadLength := 1
-	binary.Write(buf, binary.LittleEndian, statusMsg.MId)
-	binary.Write(buf, binary.LittleEndian, MTYPE_STATUS)
+	payloadLength := len(deleteMsg.Key) + 2
+	binary.Write(buf, binary.LittleEndian, deleteMsg.MId)
+	binary.Write(buf, binary.LittleEndian, MTYPE_DELETE)
 	binary.Write(buf, binary.LittleEndian, uint32(payloadLength))
-	buf.WriteByte(statusMsg.StatusCode)
+	binary.Write(buf, binary.LittleEndian, uint16(len(deleteMsg.Key)))
+	buf.Write(deleteMsg.Key)
 	data := buf.Bytes()
 
 	if len(data) != (payloadLength + 9) {
-		panic("BUG: writeOkMessage... length is wrong!")
+		panic("BUG: writeDeleteMessage... length is wrong!")
 	}
 
 	_, err := w.Write(data)
@@ -164,18 +724,20 @@ func writeStatusMessage(w io.Writer, statusMsg *Status) error {
 	return err
 }
 
-func writeResultMessage(w io.Writer, resultMsg *Result) error {
+func writeAuthMessage(w io.Writer, authMsg *Auth) error {
 	buf := new(bytes.Buffer)
-	payloadLength := len(resultMsg.Data) + 4
-	binary.Write(buf, binary.LittleEndian, resultMsg.MId)
-	binary.Write(buf, binary.LittleEndian, MTYPE_RESULT)
+	payloadLength := len(authMsg.User) + 2 + len(authMsg.Token) + 2
+	binary.Write(buf, binary.LittleEndian, authMsg.MId)
+	binary.Write(buf, binary.LittleEndian, MTYPE_AUTH)
 	binary.Write(buf, binary.LittleEndian, uint32(payloadLength))
-	binary.Write(buf, binary.LittleEndian, uint32(len(resultMsg.Data)))
-	buf.Write(resultMsg.Data)
+	binary.Write(buf, binary.LittleEndian, uint16(len(authMsg.User)))
+	buf.Write(authMsg.User)
+	binary.Write(buf, binary.LittleEndian, uint16(len(authMsg.Token)))
+	buf.Write(authMsg.Token)
 	data := buf.Bytes()
 
 	if len(data) != (payloadLength + 9) {
-		panic("BUG: writeResultMessage... length is wrong!")
+		panic("BUG: writeAuthMessage... length is wrong!")
 	}
 
 	_, err := w.Write(data)
@@ -183,78 +745,1046 @@ func writeResultMessage(w io.Writer, resultMsg *Result) error {
 	return err
 }
 
-func CreateMessage(mid uint32, mtype uint8, payload []byte) (Message, error) {
-	switch mtype {
-	case MTYPE_PUT:
-		return putMessage(mid, payload)
-	case MTYPE_GET:
-		return getMessage(mid, payload)
-	case MTYPE_STATUS:
-		return statusMessage(mid, payload)
-	case MTYPE_RESULT:
-		return resultMessage(mid, payload)
+func writeRedirectMessage(w io.Writer, redirectMsg *Redirect) error {
+	buf := new(bytes.Buffer)
+	payloadLength := len(redirectMsg.Addr) + 2
+	binary.Write(buf, binary.LittleEndian, redirectMsg.MId)
+	binary.Write(buf, binary.LittleEndian, MTYPE_REDIRECT)
+	binary.Write(buf, binary.LittleEndian, uint32(payloadLength))
+	binary.Write(buf, binary.LittleEndian, uint16(len(redirectMsg.Addr)))
+	buf.Write(redirectMsg.Addr)
+	data := buf.Bytes()
+
+	if len(data) != (payloadLength + 9) {
+		panic("BUG: writeRedirectMessage... length is wrong!")
 	}
 
-	return nil, fmt.Errorf("Unknown message type (r).")
+	_, err := w.Write(data)
+
+	return err
 }
 
-func resultMessage(mid uint32, payload []byte) (Message, error) {
-	if ulen(payload) < 4 {
-		return nil, fmt.Errorf("Payload too small for Result message. Missing data length.")
+func writeLimitsMessage(w io.Writer, limitsMsg *Limits) error {
+	buf := new(bytes.Buffer)
+	payloadLength := 12
+	binary.Write(buf, binary.LittleEndian, limitsMsg.MId)
+	binary.Write(buf, binary.LittleEndian, MTYPE_LIMITS)
+	binary.Write(buf, binary.LittleEndian, uint32(payloadLength))
+	binary.Write(buf, binary.LittleEndian, limitsMsg.MaxKeySize)
+	binary.Write(buf, binary.LittleEndian, limitsMsg.MaxValueSize)
+	binary.Write(buf, binary.LittleEndian, limitsMsg.MaxFrameSize)
+	data := buf.Bytes()
+
+	if len(data) != (payloadLength + 9) {
+		panic("BUG: writeLimitsMessage... length is wrong!")
 	}
 
-	dataLen := binary.LittleEndian.Uint32(payload[0:])
+	_, err := w.Write(data)
 
-	payload = payload[4:]
+	return err
+}
 
-	if ulen(payload) != dataLen {
-		return nil, fmt.Errorf("Payload of wrong size for Result message. Wrong data length.")
+func writeHelloMessage(w io.Writer, helloMsg *Hello) error {
+	buf := new(bytes.Buffer)
+	payloadLength := 6
+	binary.Write(buf, binary.LittleEndian, helloMsg.MId)
+	binary.Write(buf, binary.LittleEndian, MTYPE_HELLO)
+	binary.Write(buf, binary.LittleEndian, uint32(payloadLength))
+	binary.Write(buf, binary.LittleEndian, helloMsg.Version)
+	binary.Write(buf, binary.LittleEndian, helloMsg.Caps)
+	data := buf.Bytes()
+
+	if len(data) != (payloadLength + 9) {
+		panic("BUG: writeHelloMessage... length is wrong!")
 	}
 
-	return &Result{MId: mid, Data: payload}, nil
+	_, err := w.Write(data)
+
+	return err
 }
 
-func statusMessage(mid uint32, payload []byte) (Message, error) {
-	if ulen(payload) < 1 {
-		return nil, fmt.Errorf("Payload too small for Status message.")
+func writeErrorMessage(w io.Writer, errorMsg *Error) error {
+	buf := new(bytes.Buffer)
+	payloadLength := 1 + len(errorMsg.Msg) + 2 + len(errorMsg.Peer) + 2
+	binary.Write(buf, binary.LittleEndian, errorMsg.MId)
+	binary.Write(buf, binary.LittleEndian, MTYPE_ERROR)
+	binary.Write(buf, binary.LittleEndian, uint32(payloadLength))
+	buf.WriteByte(errorMsg.Code)
+	binary.Write(buf, binary.LittleEndian, uint16(len(errorMsg.Msg)))
+	buf.Write(errorMsg.Msg)
+	binary.Write(buf, binary.LittleEndian, uint16(len(errorMsg.Peer)))
+	buf.Write(errorMsg.Peer)
+	data := buf.Bytes()
+
+	if len(data) != (payloadLength + 9) {
+		panic("BUG: writeErrorMessage... length is wrong!")
+	}
+
+	_, err := w.Write(data)
+
+	return err
+}
+
+func writeMGetMessage(w io.Writer, mgetMsg *MGet) error {
+	buf := new(bytes.Buffer)
+	payloadLength := 4
+
+	for _, key := range mgetMsg.Keys {
+		payloadLength += len(key) + 2
+	}
+
+	binary.Write(buf, binary.LittleEndian, mgetMsg.MId)
+	binary.Write(buf, binary.LittleEndian, MTYPE_MGET)
+	binary.Write(buf, binary.LittleEndian, uint32(payloadLength))
+	binary.Write(buf, binary.LittleEndian, uint32(len(mgetMsg.Keys)))
+
+	for _, key := range mgetMsg.Keys {
+		binary.Write(buf, binary.LittleEndian, uint16(len(key)))
+		buf.Write(key)
+	}
+
+	data := buf.Bytes()
+
+	if len(data) != (payloadLength + 9) {
+		panic("BUG: writeMGetMessage... length is wrong!")
+	}
+
+	_, err := w.Write(data)
+
+	return err
+}
+
+func writeMPutMessage(w io.Writer, mputMsg *MPut) error {
+	if len(mputMsg.Keys) != len(mputMsg.Values) {
+		return fmt.Errorf("MPut message with %d keys but %d values.", len(mputMsg.Keys), len(mputMsg.Values))
+	}
+
+	buf := new(bytes.Buffer)
+	payloadLength := 4
+
+	for i, key := range mputMsg.Keys {
+		payloadLength += len(key) + 2 + len(mputMsg.Values[i]) + 4
+	}
+
+	binary.Write(buf, binary.LittleEndian, mputMsg.MId)
+	binary.Write(buf, binary.LittleEndian, MTYPE_MPUT)
+	binary.Write(buf, binary.LittleEndian, uint32(payloadLength))
+	binary.Write(buf, binary.LittleEndian, uint32(len(mputMsg.Keys)))
+
+	for i, key := range mputMsg.Keys {
+		binary.Write(buf, binary.LittleEndian, uint16(len(key)))
+		buf.Write(key)
+		binary.Write(buf, binary.LittleEndian, uint32(len(mputMsg.Values[i])))
+		buf.Write(mputMsg.Values[i])
+	}
+
+	data := buf.Bytes()
+
+	if len(data) != (payloadLength + 9) {
+		panic("BUG: writeMPutMessage... length is wrong!")
+	}
+
+	_, err := w.Write(data)
+
+	return err
+}
+
+func writeMResultMessage(w io.Writer, mresultMsg *MResult) error {
+	buf := new(bytes.Buffer)
+	payloadLength := 4
+
+	for i := range mresultMsg.Statuses {
+		payloadLength += 1 + 4
+
+		if i < len(mresultMsg.Values) {
+			payloadLength += len(mresultMsg.Values[i])
+		}
+	}
+
+	binary.Write(buf, binary.LittleEndian, mresultMsg.MId)
+	binary.Write(buf, binary.LittleEndian, MTYPE_MRESULT)
+	binary.Write(buf, binary.LittleEndian, uint32(payloadLength))
+	binary.Write(buf, binary.LittleEndian, uint32(len(mresultMsg.Statuses)))
+
+	for i, status := range mresultMsg.Statuses {
+		var value []byte = nil
+
+		if i < len(mresultMsg.Values) {
+			value = mresultMsg.Values[i]
+		}
+
+		buf.WriteByte(status)
+		binary.Write(buf, binary.LittleEndian, uint32(len(value)))
+		buf.Write(value)
+	}
+
+	data := buf.Bytes()
+
+	if len(data) != (payloadLength + 9) {
+		panic("BUG: writeMResultMessage... length is wrong!")
+	}
+
+	_, err := w.Write(data)
+
+	return err
+}
+
+func writeCASMessage(w io.Writer, casMsg *CAS) error {
+	buf := new(bytes.Buffer)
+	payloadLength := 8 + len(casMsg.Key) + 2 + len(casMsg.Value) + 4
+	binary.Write(buf, binary.LittleEndian, casMsg.MId)
+	binary.Write(buf, binary.LittleEndian, MTYPE_CAS)
+	binary.Write(buf, binary.LittleEndian, uint32(payloadLength))
+	binary.Write(buf, binary.LittleEndian, casMsg.Version)
+	binary.Write(buf, binary.LittleEndian, uint16(len(casMsg.Key)))
+	buf.Write(casMsg.Key)
+	binary.Write(buf, binary.LittleEndian, uint32(len(casMsg.Value)))
+	buf.Write(casMsg.Value)
+	data := buf.Bytes()
+
+	if len(data) != (payloadLength + 9) {
+		panic("BUG: writeCASMessage... length is wrong!")
+	}
+
+	_, err := w.Write(data)
+
+	return err
+}
+
+func writeVResultMessage(w io.Writer, vresultMsg *VResult) error {
+	buf := new(bytes.Buffer)
+	payloadLength := 8 + len(vresultMsg.Data) + 4
+	binary.Write(buf, binary.LittleEndian, vresultMsg.MId)
+	binary.Write(buf, binary.LittleEndian, MTYPE_VRESULT)
+	binary.Write(buf, binary.LittleEndian, uint32(payloadLength))
+	binary.Write(buf, binary.LittleEndian, vresultMsg.Version)
+	binary.Write(buf, binary.LittleEndian, uint32(len(vresultMsg.Data)))
+	buf.Write(vresultMsg.Data)
+	data := buf.Bytes()
+
+	if len(data) != (payloadLength + 9) {
+		panic("BUG: writeVResultMessage... length is wrong!")
+	}
+
+	_, err := w.Write(data)
+
+	return err
+}
+
+func writeRPutMessage(w io.Writer, rputMsg *RPut) error {
+	if len(rputMsg.Keys) != len(rputMsg.Values) || len(rputMsg.Keys) != len(rputMsg.Versions) || len(rputMsg.Keys) != len(rputMsg.Expires) {
+		return fmt.Errorf("RPut message with %d keys, %d values, %d versions and %d expiry times.", len(rputMsg.Keys), len(rputMsg.Values), len(rputMsg.Versions), len(rputMsg.Expires))
+	}
+
+	buf := new(bytes.Buffer)
+	payloadLength := 4
+
+	for i, key := range rputMsg.Keys {
+		payloadLength += len(key) + 2 + 8 + 8 + len(rputMsg.Values[i]) + 4
+	}
+
+	binary.Write(buf, binary.LittleEndian, rputMsg.MId)
+	binary.Write(buf, binary.LittleEndian, MTYPE_RPUT)
+	binary.Write(buf, binary.LittleEndian, uint32(payloadLength))
+	binary.Write(buf, binary.LittleEndian, uint32(len(rputMsg.Keys)))
+
+	for i, key := range rputMsg.Keys {
+		binary.Write(buf, binary.LittleEndian, uint16(len(key)))
+		buf.Write(key)
+		binary.Write(buf, binary.LittleEndian, rputMsg.Versions[i])
+
+		if rputMsg.Expires[i].IsZero() {
+			binary.Write(buf, binary.LittleEndian, uint64(0))
+		} else {
+			binary.Write(buf, binary.LittleEndian, uint64(rputMsg.Expires[i].UnixNano()))
+		}
+
+		binary.Write(buf, binary.LittleEndian, uint32(len(rputMsg.Values[i])))
+		buf.Write(rputMsg.Values[i])
+	}
+
+	data := buf.Bytes()
+
+	if len(data) != (payloadLength + 9) {
+		panic("BUG: writeRPutMessage... length is wrong!")
+	}
+
+	_, err := w.Write(data)
+
+	return err
+}
+
+func writePutTTLMessage(w io.Writer, putttlMsg *PutTTL) error {
+	buf := new(bytes.Buffer)
+	payloadLength := 8 + len(putttlMsg.Key) + 2 + len(putttlMsg.Value) + 4
+	binary.Write(buf, binary.LittleEndian, putttlMsg.MId)
+	binary.Write(buf, binary.LittleEndian, MTYPE_PUTTTL)
+	binary.Write(buf, binary.LittleEndian, uint32(payloadLength))
+	binary.Write(buf, binary.LittleEndian, putttlMsg.TTL)
+	binary.Write(buf, binary.LittleEndian, uint16(len(putttlMsg.Key)))
+	buf.Write(putttlMsg.Key)
+	binary.Write(buf, binary.LittleEndian, uint32(len(putttlMsg.Value)))
+	buf.Write(putttlMsg.Value)
+	data := buf.Bytes()
+
+	if len(data) != (payloadLength + 9) {
+		panic("BUG: writePutTTLMessage... length is wrong!")
+	}
+
+	_, err := w.Write(data)
+
+	return err
+}
+
+func writeIncrMessage(w io.Writer, incrMsg *Incr) error {
+	buf := new(bytes.Buffer)
+	payloadLength := 8 + len(incrMsg.Key) + 2
+	binary.Write(buf, binary.LittleEndian, incrMsg.MId)
+	binary.Write(buf, binary.LittleEndian, MTYPE_INCR)
+	binary.Write(buf, binary.LittleEndian, uint32(payloadLength))
+	binary.Write(buf, binary.LittleEndian, incrMsg.Delta)
+	binary.Write(buf, binary.LittleEndian, uint16(len(incrMsg.Key)))
+	buf.Write(incrMsg.Key)
+	data := buf.Bytes()
+
+	if len(data) != (payloadLength + 9) {
+		panic("BUG: writeIncrMessage... length is wrong!")
+	}
+
+	_, err := w.Write(data)
+
+	return err
+}
+
+func writeScanMessage(w io.Writer, scanMsg *Scan) error {
+	buf := new(bytes.Buffer)
+	payloadLength := len(scanMsg.Start) + 2 + len(scanMsg.End) + 2 + len(scanMsg.Prefix) + 2 + 4
+	binary.Write(buf, binary.LittleEndian, scanMsg.MId)
+	binary.Write(buf, binary.LittleEndian, MTYPE_SCAN)
+	binary.Write(buf, binary.LittleEndian, uint32(payloadLength))
+	binary.Write(buf, binary.LittleEndian, uint16(len(scanMsg.Start)))
+	buf.Write(scanMsg.Start)
+	binary.Write(buf, binary.LittleEndian, uint16(len(scanMsg.End)))
+	buf.Write(scanMsg.End)
+	binary.Write(buf, binary.LittleEndian, uint16(len(scanMsg.Prefix)))
+	buf.Write(scanMsg.Prefix)
+	binary.Write(buf, binary.LittleEndian, scanMsg.Limit)
+	data := buf.Bytes()
+
+	if len(data) != (payloadLength + 9) {
+		panic("BUG: writeScanMessage... length is wrong!")
+	}
+
+	_, err := w.Write(data)
+
+	return err
+}
+
+func writeScanResultMessage(w io.Writer, scanresultMsg *ScanResult) error {
+	if len(scanresultMsg.Keys) != len(scanresultMsg.Values) {
+		return fmt.Errorf("ScanResult message with %d keys but %d values.", len(scanresultMsg.Keys), len(scanresultMsg.Values))
+	}
+
+	buf := new(bytes.Buffer)
+	payloadLength := 1 + 4
+
+	for i, key := range scanresultMsg.Keys {
+		payloadLength += len(key) + 2 + len(scanresultMsg.Values[i]) + 4
+	}
+
+	more := uint8(0)
+
+	if scanresultMsg.More {
+		more = 1
+	}
+
+	binary.Write(buf, binary.LittleEndian, scanresultMsg.MId)
+	binary.Write(buf, binary.LittleEndian, MTYPE_SCANRESULT)
+	binary.Write(buf, binary.LittleEndian, uint32(payloadLength))
+	buf.WriteByte(more)
+	binary.Write(buf, binary.LittleEndian, uint32(len(scanresultMsg.Keys)))
+
+	for i, key := range scanresultMsg.Keys {
+		binary.Write(buf, binary.LittleEndian, uint16(len(key)))
+		buf.Write(key)
+		binary.Write(buf, binary.LittleEndian, uint32(len(scanresultMsg.Values[i])))
+		buf.Write(scanresultMsg.Values[i])
+	}
+
+	data := buf.Bytes()
+
+	if len(data) != (payloadLength + 9) {
+		panic("BUG: writeScanResultMessage... length is wrong!")
+	}
+
+	_, err := w.Write(data)
+
+	return err
+}
+
+func writeSnapshotMessage(w io.Writer, snapshotMsg *Snapshot) error {
+	buf := new(bytes.Buffer)
+	payloadLength := 1
+	binary.Write(buf, binary.LittleEndian, snapshotMsg.MId)
+	binary.Write(buf, binary.LittleEndian, MTYPE_SNAPSHOT)
+	binary.Write(buf, binary.LittleEndian, uint32(payloadLength))
+	buf.WriteByte(snapshotMsg.Phase)
+	data := buf.Bytes()
+
+	if len(data) != (payloadLength + 9) {
+		panic("BUG: writeSnapshotMessage... length is wrong!")
+	}
+
+	_, err := w.Write(data)
+
+	return err
+}
+
+func writeLGetMessage(w io.Writer, lgetMsg *LGet) error {
+	buf := new(bytes.Buffer)
+	payloadLength := len(lgetMsg.Key) + 2
+	binary.Write(buf, binary.LittleEndian, lgetMsg.MId)
+	binary.Write(buf, binary.LittleEndian, MTYPE_LGET)
+	binary.Write(buf, binary.LittleEndian, uint32(payloadLength))
+	binary.Write(buf, binary.LittleEndian, uint16(len(lgetMsg.Key)))
+	buf.Write(lgetMsg.Key)
+	data := buf.Bytes()
+
+	if len(data) != (payloadLength + 9) {
+		panic("BUG: writeLGetMessage... length is wrong!")
+	}
+
+	_, err := w.Write(data)
+
+	return err
+}
+
+func writeStatusMessage(w io.Writer, statusMsg *Status) error {
+	buf := new(bytes.Buffer)
+	payloadLength := 1
+	binary.Write(buf, binary.LittleEndian, statusMsg.MId)
+	binary.Write(buf, binary.LittleEndian, MTYPE_STATUS)
+	binary.Write(buf, binary.LittleEndian, uint32(payloadLength))
+	buf.WriteByte(statusMsg.StatusCode)
+	data := buf.Bytes()
+
+	if len(data) != (payloadLength + 9) {
+		panic("BUG: writeOkMessage... length is wrong!")
+	}
+
+	_, err := w.Write(data)
+
+	return err
+}
+
+func writeResultMessage(w io.Writer, resultMsg *Result) error {
+	buf := new(bytes.Buffer)
+	payloadLength := len(resultMsg.Data) + 4
+	binary.Write(buf, binary.LittleEndian, resultMsg.MId)
+	binary.Write(buf, binary.LittleEndian, MTYPE_RESULT)
+	binary.Write(buf, binary.LittleEndian, uint32(payloadLength))
+	binary.Write(buf, binary.LittleEndian, uint32(len(resultMsg.Data)))
+	buf.Write(resultMsg.Data)
+	data := buf.Bytes()
+
+	if len(data) != (payloadLength + 9) {
+		panic("BUG: writeResultMessage... length is wrong!")
+	}
+
+	_, err := w.Write(data)
+
+	return err
+}
+
+func CreateMessage(mid uint32, mtype uint8, payload []byte) (Message, error) {
+	switch mtype {
+	case MTYPE_PUT:
+		return putMessage(mid, payload)
+	case MTYPE_GET:
+		return getMessage(mid, payload)
+	case MTYPE_STATUS:
+		return statusMessage(mid, payload)
+	case MTYPE_RESULT:
+		return resultMessage(mid, payload)
+	case MTYPE_DELETE:
+		return deleteMessage(mid, payload)
+	case MTYPE_AUTH:
+		return authMessage(mid, payload)
+	case MTYPE_REDIRECT:
+		return redirectMessage(mid, payload)
+	case MTYPE_LIMITS:
+		return limitsMessage(mid, payload)
+	case MTYPE_HELLO:
+		return helloMessage(mid, payload)
+	case MTYPE_ERROR:
+		return errorMessage(mid, payload)
+	case MTYPE_MGET:
+		return mgetMessage(mid, payload)
+	case MTYPE_CAS:
+		return casMessage(mid, payload)
+	case MTYPE_VRESULT:
+		return vresultMessage(mid, payload)
+	case MTYPE_RPUT:
+		return rputMessage(mid, payload)
+	case MTYPE_PUTTTL:
+		return putttlMessage(mid, payload)
+	case MTYPE_INCR:
+		return incrMessage(mid, payload)
+	case MTYPE_SCAN:
+		return scanMessage(mid, payload)
+	case MTYPE_SCANRESULT:
+		return scanresultMessage(mid, payload)
+	case MTYPE_SNAPSHOT:
+		return snapshotMessage(mid, payload)
+	case MTYPE_LGET:
+		return lgetMessage(mid, payload)
+	case MTYPE_MPUT:
+		return mputMessage(mid, payload)
+	case MTYPE_MRESULT:
+		return mresultMessage(mid, payload)
+	}
+
+	return nil, &UnknownTypeError{MId: mid, MType: mtype}
+}
+
+func resultMessage(mid uint32, payload []byte) (Message, error) {
+	if ulen(payload) < 4 {
+		return nil, fmt.Errorf("Payload too small for Result message. Missing data length.")
+	}
+
+	dataLen := binary.LittleEndian.Uint32(payload[0:])
+
+	payload = payload[4:]
+
+	if ulen(payload) != dataLen {
+		return nil, fmt.Errorf("Payload of wrong size for Result message. Wrong data length.")
+	}
+
+	return &Result{MId: mid, Data: payload}, nil
+}
+
+func statusMessage(mid uint32, payload []byte) (Message, error) {
+	if ulen(payload) < 1 {
+		return nil, fmt.Errorf("Payload too small for Status message.")
 	}
 
 	statusCode := payload[0]
 
-	if len(payload) > 1 {
-		return nil, fmt.Errorf("Payload too big for Status message. Trailing bytes detected.")
+	if len(payload) > 1 {
+		return nil, fmt.Errorf("Payload too big for Status message. Trailing bytes detected.")
+	}
+
+	return &Status{MId: mid, StatusCode: statusCode}, nil
+}
+
+func getMessage(mid uint32, payload []byte) (Message, error) {
+	if ulen(payload) < 2 {
+		return nil, fmt.Errorf("Payload too small for Get message. Missing key length.")
+	}
+
+	keyLen := uint32(binary.LittleEndian.Uint16(payload[0:]))
+
+	payload = payload[2:]
+
+	if ulen(payload) < keyLen {
+		return nil, fmt.Errorf("Payload too small for Get message. Missing key bytes.")
+	}
+
+	keyBytes := payload[:keyLen]
+
+	payload = payload[keyLen:]
+
+	if len(payload) != 0 {
+		return nil, fmt.Errorf("Payload too big for Get message. Trailing bytes detected.")
+	}
+
+	return &Get{MId: mid, Key: keyBytes}, nil
+}
+
+func deleteMessage(mid uint32, payload []byte) (Message, error) {
+	if ulen(payload) < 2 {
+		return nil, fmt.Errorf("Payload too small for Delete message. Missing key length.")
+	}
+
+	keyLen := uint32(binary.LittleEndian.Uint16(payload[0:]))
+
+	payload = payload[2:]
+
+	if ulen(payload) < keyLen {
+		return nil, fmt.Errorf("Payload too small for Delete message. Missing key bytes.")
+	}
+
+	keyBytes := payload[:keyLen]
+
+	payload = payload[keyLen:]
+
+	if len(payload) != 0 {
+		return nil, fmt.Errorf("Payload too big for Delete message. Trailing bytes detected.")
+	}
+
+	return &Delete{MId: mid, Key: keyBytes}, nil
+}
+
+func authMessage(mid uint32, payload []byte) (Message, error) {
+	if ulen(payload) < 2 {
+		return nil, fmt.Errorf("Payload too small for Auth message. Missing user length.")
+	}
+
+	userLen := uint32(binary.LittleEndian.Uint16(payload[0:]))
+
+	payload = payload[2:]
+
+	if ulen(payload) < userLen {
+		return nil, fmt.Errorf("Payload too small for Auth message. Missing user bytes.")
+	}
+
+	userBytes := payload[:userLen]
+
+	payload = payload[userLen:]
+
+	if ulen(payload) < 2 {
+		return nil, fmt.Errorf("Payload too small for Auth message. Missing token length.")
+	}
+
+	tokenLen := uint32(binary.LittleEndian.Uint16(payload[0:]))
+
+	payload = payload[2:]
+
+	if ulen(payload) < tokenLen {
+		return nil, fmt.Errorf("Payload too small for Auth message. Missing token bytes.")
+	}
+
+	tokenBytes := payload[:tokenLen]
+
+	payload = payload[tokenLen:]
+
+	if len(payload) != 0 {
+		return nil, fmt.Errorf("Payload too big for Auth message. Trailing bytes detected.")
+	}
+
+	return &Auth{MId: mid, User: userBytes, Token: tokenBytes}, nil
+}
+
+func putMessage(mid uint32, payload []byte) (Message, error) {
+	if ulen(payload) < 2 {
+		return nil, fmt.Errorf("Payload too small for Put message. Missing key length.")
+	}
+
+	keyLen := uint32(binary.LittleEndian.Uint16(payload[0:]))
+
+	payload = payload[2:]
+
+	if ulen(payload) < keyLen {
+		return nil, fmt.Errorf("Payload too small for Put message. Missing key bytes.")
+	}
+
+	keyBytes := payload[:keyLen]
+
+	payload = payload[keyLen:]
+
+	if ulen(payload) < 4 {
+		return nil, fmt.Errorf("Payload too small for Put message. Missing value length.")
 	}
 
-	return &Status{MId: mid, StatusCode: statusCode}, nil
+	valueLen := binary.LittleEndian.Uint32(payload[0:])
+
+	payload = payload[4:]
+
+	if ulen(payload) < valueLen {
+		return nil, fmt.Errorf("Payload too small for Put message. Missing value bytes.")
+	}
+
+	valueBytes := payload[:valueLen]
+
+	payload = payload[valueLen:]
+
+	if len(payload) != 0 {
+		return nil, fmt.Errorf("Payload too big for Put message. Trailing bytes detected.")
+	}
+
+	return &Put{MId: mid, Key : keyBytes, Value : valueBytes}, nil
 }
 
-func getMessage(mid uint32, payload []byte) (Message, error) {
+func redirectMessage(mid uint32, payload []byte) (Message, error) {
 	if ulen(payload) < 2 {
-		return nil, fmt.Errorf("Payload too small for Get message. Missing key length.")
+		return nil, fmt.Errorf("Payload too small for Redirect message. Missing address length.")
 	}
 
-	keyLen := uint32(binary.LittleEndian.Uint16(payload[0:]))
+	addrLen := uint32(binary.LittleEndian.Uint16(payload[0:]))
 
 	payload = payload[2:]
 
-	if ulen(payload) < keyLen {
-		return nil, fmt.Errorf("Payload too small for Get message. Missing key bytes.")
+	if ulen(payload) < addrLen {
+		return nil, fmt.Errorf("Payload too small for Redirect message. Missing address bytes.")
 	}
 
-	keyBytes := payload[:keyLen]
+	addrBytes := payload[:addrLen]
 
-	payload = payload[keyLen:]
+	payload = payload[addrLen:]
 
 	if len(payload) != 0 {
-		return nil, fmt.Errorf("Payload too big for Get message. Trailing bytes detected.")
+		return nil, fmt.Errorf("Payload too big for Redirect message. Trailing bytes detected.")
 	}
 
-	return &Get{MId: mid, Key: keyBytes}, nil
+	return &Redirect{MId: mid, Addr: addrBytes}, nil
 }
 
-func putMessage(mid uint32, payload []byte) (Message, error) {
+func limitsMessage(mid uint32, payload []byte) (Message, error) {
+	if ulen(payload) < 12 {
+		return nil, fmt.Errorf("Payload too small for Limits message. Missing limits.")
+	}
+
+	if len(payload) > 12 {
+		return nil, fmt.Errorf("Payload too big for Limits message. Trailing bytes detected.")
+	}
+
+	return &Limits{
+		MId: mid,
+		MaxKeySize: binary.LittleEndian.Uint32(payload[0:]),
+		MaxValueSize: binary.LittleEndian.Uint32(payload[4:]),
+		MaxFrameSize: binary.LittleEndian.Uint32(payload[8:]),
+	}, nil
+}
+
+func helloMessage(mid uint32, payload []byte) (Message, error) {
+	if ulen(payload) < 6 {
+		return nil, fmt.Errorf("Payload too small for Hello message. Missing version or capabilities.")
+	}
+
+	if len(payload) > 6 {
+		return nil, fmt.Errorf("Payload too big for Hello message. Trailing bytes detected.")
+	}
+
+	return &Hello{
+		MId: mid,
+		Version: binary.LittleEndian.Uint16(payload[0:]),
+		Caps: binary.LittleEndian.Uint32(payload[2:]),
+	}, nil
+}
+
+func errorMessage(mid uint32, payload []byte) (Message, error) {
+	if ulen(payload) < 1 {
+		return nil, fmt.Errorf("Payload too small for Error message. Missing code.")
+	}
+
+	code := payload[0]
+
+	payload = payload[1:]
+
 	if ulen(payload) < 2 {
-		return nil, fmt.Errorf("Payload too small for Put message. Missing key length.")
+		return nil, fmt.Errorf("Payload too small for Error message. Missing message length.")
+	}
+
+	msgLen := uint32(binary.LittleEndian.Uint16(payload[0:]))
+
+	payload = payload[2:]
+
+	if ulen(payload) < msgLen {
+		return nil, fmt.Errorf("Payload too small for Error message. Missing message bytes.")
+	}
+
+	msgBytes := payload[:msgLen]
+
+	payload = payload[msgLen:]
+
+	if ulen(payload) < 2 {
+		return nil, fmt.Errorf("Payload too small for Error message. Missing peer length.")
+	}
+
+	peerLen := uint32(binary.LittleEndian.Uint16(payload[0:]))
+
+	payload = payload[2:]
+
+	if ulen(payload) < peerLen {
+		return nil, fmt.Errorf("Payload too small for Error message. Missing peer bytes.")
+	}
+
+	peerBytes := payload[:peerLen]
+
+	payload = payload[peerLen:]
+
+	if len(payload) != 0 {
+		return nil, fmt.Errorf("Payload too big for Error message. Trailing bytes detected.")
+	}
+
+	return &Error{MId: mid, Code: code, Msg: msgBytes, Peer: peerBytes}, nil
+}
+
+// Reads the entry count of a batch message and checks that the
+// payload can hold that many entries of at least minSize bytes.
+func batchCount(payload []byte, minSize uint32, what string) (uint32, []byte, error) {
+	if ulen(payload) < 4 {
+		return 0, nil, fmt.Errorf("Payload too small for %s message. Missing count.", what)
+	}
+
+	count := binary.LittleEndian.Uint32(payload[0:])
+
+	payload = payload[4:]
+
+	if uint64(count) * uint64(minSize) > uint64(len(payload)) {
+		return 0, nil, fmt.Errorf("Payload too small for %s message. Missing entries.", what)
+	}
+
+	return count, payload, nil
+}
+
+func mgetMessage(mid uint32, payload []byte) (Message, error) {
+	count, payload, err := batchCount(payload, 2, "MGet")
+
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([][]byte, count)
+
+	for i := range keys {
+		if ulen(payload) < 2 {
+			return nil, fmt.Errorf("Payload too small for MGet message. Missing key length.")
+		}
+
+		keyLen := uint32(binary.LittleEndian.Uint16(payload[0:]))
+
+		payload = payload[2:]
+
+		if ulen(payload) < keyLen {
+			return nil, fmt.Errorf("Payload too small for MGet message. Missing key bytes.")
+		}
+
+		keys[i] = payload[:keyLen]
+
+		payload = payload[keyLen:]
+	}
+
+	if len(payload) != 0 {
+		return nil, fmt.Errorf("Payload too big for MGet message. Trailing bytes detected.")
+	}
+
+	return &MGet{MId: mid, Keys: keys}, nil
+}
+
+func mputMessage(mid uint32, payload []byte) (Message, error) {
+	count, payload, err := batchCount(payload, 6, "MPut")
+
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([][]byte, count)
+	values := make([][]byte, count)
+
+	for i := range keys {
+		if ulen(payload) < 2 {
+			return nil, fmt.Errorf("Payload too small for MPut message. Missing key length.")
+		}
+
+		keyLen := uint32(binary.LittleEndian.Uint16(payload[0:]))
+
+		payload = payload[2:]
+
+		if ulen(payload) < keyLen {
+			return nil, fmt.Errorf("Payload too small for MPut message. Missing key bytes.")
+		}
+
+		keys[i] = payload[:keyLen]
+
+		payload = payload[keyLen:]
+
+		if ulen(payload) < 4 {
+			return nil, fmt.Errorf("Payload too small for MPut message. Missing value length.")
+		}
+
+		valueLen := binary.LittleEndian.Uint32(payload[0:])
+
+		payload = payload[4:]
+
+		if ulen(payload) < valueLen {
+			return nil, fmt.Errorf("Payload too small for MPut message. Missing value bytes.")
+		}
+
+		values[i] = payload[:valueLen]
+
+		payload = payload[valueLen:]
+	}
+
+	if len(payload) != 0 {
+		return nil, fmt.Errorf("Payload too big for MPut message. Trailing bytes detected.")
+	}
+
+	return &MPut{MId: mid, Keys: keys, Values: values}, nil
+}
+
+func mresultMessage(mid uint32, payload []byte) (Message, error) {
+	count, payload, err := batchCount(payload, 5, "MResult")
+
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]uint8, count)
+	values := make([][]byte, count)
+
+	for i := range statuses {
+		if ulen(payload) < 5 {
+			return nil, fmt.Errorf("Payload too small for MResult message. Missing status or data length.")
+		}
+
+		statuses[i] = payload[0]
+		dataLen := binary.LittleEndian.Uint32(payload[1:])
+
+		payload = payload[5:]
+
+		if ulen(payload) < dataLen {
+			return nil, fmt.Errorf("Payload too small for MResult message. Missing data bytes.")
+		}
+
+		values[i] = payload[:dataLen]
+
+		payload = payload[dataLen:]
+	}
+
+	if len(payload) != 0 {
+		return nil, fmt.Errorf("Payload too big for MResult message. Trailing bytes detected.")
+	}
+
+	return &MResult{MId: mid, Statuses: statuses, Values: values}, nil
+}
+
+func casMessage(mid uint32, payload []byte) (Message, error) {
+	if ulen(payload) < 8 {
+		return nil, fmt.Errorf("Payload too small for CAS message. Missing version.")
+	}
+
+	version := binary.LittleEndian.Uint64(payload[0:])
+
+	msg, err := putMessage(mid, payload[8:])
+
+	if err != nil {
+		return nil, err
+	}
+
+	putMsg := msg.(*Put)
+
+	return &CAS{MId: mid, Version: version, Key: putMsg.Key, Value: putMsg.Value}, nil
+}
+
+func vresultMessage(mid uint32, payload []byte) (Message, error) {
+	if ulen(payload) < 8 {
+		return nil, fmt.Errorf("Payload too small for VResult message. Missing version.")
+	}
+
+	version := binary.LittleEndian.Uint64(payload[0:])
+
+	msg, err := resultMessage(mid, payload[8:])
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &VResult{MId: mid, Version: version, Data: msg.(*Result).Data}, nil
+}
+
+func rputMessage(mid uint32, payload []byte) (Message, error) {
+	count, payload, err := batchCount(payload, 22, "RPut")
+
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([][]byte, count)
+	values := make([][]byte, count)
+	versions := make([]uint64, count)
+	expires := make([]time.Time, count)
+
+	for i := range keys {
+		if ulen(payload) < 2 {
+			return nil, fmt.Errorf("Payload too small for RPut message. Missing key length.")
+		}
+
+		keyLen := uint32(binary.LittleEndian.Uint16(payload[0:]))
+
+		payload = payload[2:]
+
+		if ulen(payload) < keyLen {
+			return nil, fmt.Errorf("Payload too small for RPut message. Missing key bytes.")
+		}
+
+		keys[i] = payload[:keyLen]
+
+		payload = payload[keyLen:]
+
+		if ulen(payload) < 8 {
+			return nil, fmt.Errorf("Payload too small for RPut message. Missing version.")
+		}
+
+		versions[i] = binary.LittleEndian.Uint64(payload[0:])
+
+		payload = payload[8:]
+
+		if ulen(payload) < 8 {
+			return nil, fmt.Errorf("Payload too small for RPut message. Missing expiry time.")
+		}
+
+		nanos := binary.LittleEndian.Uint64(payload[0:])
+
+		if nanos != 0 {
+			expires[i] = time.Unix(0, int64(nanos))
+		}
+
+		payload = payload[8:]
+
+		if ulen(payload) < 4 {
+			return nil, fmt.Errorf("Payload too small for RPut message. Missing value length.")
+		}
+
+		valueLen := binary.LittleEndian.Uint32(payload[0:])
+
+		payload = payload[4:]
+
+		if ulen(payload) < valueLen {
+			return nil, fmt.Errorf("Payload too small for RPut message. Missing value bytes.")
+		}
+
+		values[i] = payload[:valueLen]
+
+		payload = payload[valueLen:]
+	}
+
+	if len(payload) != 0 {
+		return nil, fmt.Errorf("Payload too big for RPut message. Trailing bytes detected.")
+	}
+
+	return &RPut{MId: mid, Keys: keys, Values: values, Versions: versions, Expires: expires}, nil
+}
+
+func putttlMessage(mid uint32, payload []byte) (Message, error) {
+	if ulen(payload) < 8 {
+		return nil, fmt.Errorf("Payload too small for PutTTL message. Missing TTL.")
+	}
+
+	ttl := binary.LittleEndian.Uint64(payload[0:])
+
+	msg, err := putMessage(mid, payload[8:])
+
+	if err != nil {
+		return nil, err
+	}
+
+	putMsg := msg.(*Put)
+
+	return &PutTTL{MId: mid, TTL: ttl, Key: putMsg.Key, Value: putMsg.Value}, nil
+}
+
+func incrMessage(mid uint32, payload []byte) (Message, error) {
+	if ulen(payload) < 8 {
+		return nil, fmt.Errorf("Payload too small for Incr message. Missing delta.")
+	}
+
+	delta := int64(binary.LittleEndian.Uint64(payload[0:]))
+
+	payload = payload[8:]
+
+	if ulen(payload) < 2 {
+		return nil, fmt.Errorf("Payload too small for Incr message. Missing key length.")
 	}
 
 	keyLen := uint32(binary.LittleEndian.Uint16(payload[0:]))
@@ -262,32 +1792,134 @@ func putMessage(mid uint32, payload []byte) (Message, error) {
 	payload = payload[2:]
 
 	if ulen(payload) < keyLen {
-		return nil, fmt.Errorf("Payload too small for Put message. Missing key bytes.")
+		return nil, fmt.Errorf("Payload too small for Incr message. Missing key bytes.")
 	}
 
 	keyBytes := payload[:keyLen]
 
 	payload = payload[keyLen:]
 
+	if len(payload) != 0 {
+		return nil, fmt.Errorf("Payload too big for Incr message. Trailing bytes detected.")
+	}
+
+	return &Incr{MId: mid, Delta: delta, Key: keyBytes}, nil
+}
+
+func scanMessage(mid uint32, payload []byte) (Message, error) {
+	keys := make([][]byte, 3)
+	names := []string{"start", "end", "prefix"}
+
+	for i, name := range names {
+		if ulen(payload) < 2 {
+			return nil, fmt.Errorf("Payload too small for Scan message. Missing %s length.", name)
+		}
+
+		keyLen := uint32(binary.LittleEndian.Uint16(payload[0:]))
+
+		payload = payload[2:]
+
+		if ulen(payload) < keyLen {
+			return nil, fmt.Errorf("Payload too small for Scan message. Missing %s bytes.", name)
+		}
+
+		keys[i] = payload[:keyLen]
+
+		payload = payload[keyLen:]
+	}
+
 	if ulen(payload) < 4 {
-		return nil, fmt.Errorf("Payload too small for Put message. Missing value length.")
+		return nil, fmt.Errorf("Payload too small for Scan message. Missing limit.")
 	}
 
-	valueLen := binary.LittleEndian.Uint32(payload[0:])
+	limit := binary.LittleEndian.Uint32(payload[0:])
 
 	payload = payload[4:]
 
-	if ulen(payload) < valueLen {
-		return nil, fmt.Errorf("Payload too small for Put message. Missing value bytes.")
+	if len(payload) != 0 {
+		return nil, fmt.Errorf("Payload too big for Scan message. Trailing bytes detected.")
 	}
 
-	valueBytes := payload[:valueLen]
+	return &Scan{MId: mid, Start: keys[0], End: keys[1], Prefix: keys[2], Limit: limit}, nil
+}
 
-	payload = payload[valueLen:]
+func scanresultMessage(mid uint32, payload []byte) (Message, error) {
+	if ulen(payload) < 1 {
+		return nil, fmt.Errorf("Payload too small for ScanResult message. Missing more flag.")
+	}
+
+	more := payload[0] != 0
+
+	count, payload, err := batchCount(payload[1:], 6, "ScanResult")
+
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([][]byte, count)
+	values := make([][]byte, count)
+
+	for i := range keys {
+		if ulen(payload) < 2 {
+			return nil, fmt.Errorf("Payload too small for ScanResult message. Missing key length.")
+		}
+
+		keyLen := uint32(binary.LittleEndian.Uint16(payload[0:]))
+
+		payload = payload[2:]
+
+		if ulen(payload) < keyLen {
+			return nil, fmt.Errorf("Payload too small for ScanResult message. Missing key bytes.")
+		}
+
+		keys[i] = payload[:keyLen]
+
+		payload = payload[keyLen:]
+
+		if ulen(payload) < 4 {
+			return nil, fmt.Errorf("Payload too small for ScanResult message. Missing value length.")
+		}
+
+		valueLen := binary.LittleEndian.Uint32(payload[0:])
+
+		payload = payload[4:]
+
+		if ulen(payload) < valueLen {
+			return nil, fmt.Errorf("Payload too small for ScanResult message. Missing value bytes.")
+		}
+
+		values[i] = payload[:valueLen]
+
+		payload = payload[valueLen:]
+	}
 
 	if len(payload) != 0 {
-		return nil, fmt.Errorf("Payload too big for Put message. Trailing bytes detected.")
+		return nil, fmt.Errorf("Payload too big for ScanResult message. Trailing bytes detected.")
 	}
 
-	return &Put{MId: mid, Key : keyBytes, Value : valueBytes}, nil
+	return &ScanResult{MId: mid, More: more, Keys: keys, Values: values}, nil
+}
+
+func snapshotMessage(mid uint32, payload []byte) (Message, error) {
+	if ulen(payload) < 1 {
+		return nil, fmt.Errorf("Payload too small for Snapshot message.")
+	}
+
+	phase := payload[0]
+
+	if len(payload) > 1 {
+		return nil, fmt.Errorf("Payload too big for Snapshot message. Trailing bytes detected.")
+	}
+
+	return &Snapshot{MId: mid, Phase: phase}, nil
+}
+
+func lgetMessage(mid uint32, payload []byte) (Message, error) {
+	msg, err := getMessage(mid, payload)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &LGet{MId: mid, Key: msg.(*Get).Key}, nil
 }
@@ -0,0 +1,215 @@
+package mydb
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Connected and usable.
+const PEERSTATE_CONNECTED = uint8(0x01)
+
+// Connection lost, trying to connect again.
+const PEERSTATE_RECONNECTING = uint8(0x02)
+
+// Connection lost and several attempts to connect again failed.
+// Attempts continue at the maximum delay.
+const PEERSTATE_DOWN = uint8(0x03)
+
+// Failed attempts before a peer is considered down.
+const PEER_DOWN_AFTER = 5
+
+// Connection to another server (a replica or a lookup server) that
+// is re-established with exponential backoff when it breaks.
+type peer struct {
+	raddr string
+	dial func() (*pipeline, error)
+	pipe *pipeline
+	state uint8
+	timeout time.Duration
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	onReconnect func()
+	done chan struct{}
+	mutex *sync.Mutex
+	logger Logger
+}
+
+func dialPeer(raddr string, dial func() (*pipeline, error), timeout time.Duration, minBackoff time.Duration, maxBackoff time.Duration, logger Logger) (*peer, error) {
+	pipe, err := dial()
+
+	if err != nil {
+		return nil, err
+	}
+
+	p := &peer{
+		raddr: raddr,
+		dial: dial,
+		timeout: timeout,
+		minBackoff: minBackoff,
+		maxBackoff: maxBackoff,
+		done: make(chan struct{}),
+		mutex: &sync.Mutex{},
+		logger: logger,
+	}
+
+	p.connected(pipe)
+
+	return p, nil
+}
+
+func (p *peer) String() string {
+	return p.raddr
+}
+
+func (p *peer) State() uint8 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.state
+}
+
+// Called after the connection was established again.
+func (p *peer) setOnReconnect(fn func()) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.onReconnect = fn
+}
+
+// Breaks the connection if the peer doesn't answer in time.
+func (p *peer) roundTrip(msg Message) (Message, error) {
+	p.mutex.Lock()
+	pipe := p.pipe
+	state := p.state
+	p.mutex.Unlock()
+
+	if state != PEERSTATE_CONNECTED {
+		return nil, fmt.Errorf("Not connected to %s.", p.raddr)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+
+	retMsg, err := pipe.roundTripContext(ctx, msg)
+
+	if err == context.DeadlineExceeded {
+		// Whatever is queued behind it is stuck as well. Breaking
+		// the connection has watch connect again.
+		err = fmt.Errorf("No response from %s within %s.", p.raddr, p.timeout)
+		pipe.fail(err)
+	}
+
+	return retMsg, err
+}
+
+// Switches over to the new connection. Returns false and closes it
+// if the peer was closed while dialing.
+func (p *peer) connected(pipe *pipeline) bool {
+	p.mutex.Lock()
+
+	select {
+	case <-p.done:
+		p.mutex.Unlock()
+		pipe.close()
+		return false
+	default:
+	}
+
+	p.pipe = pipe
+	p.state = PEERSTATE_CONNECTED
+	p.mutex.Unlock()
+
+	go p.watch(pipe)
+
+	return true
+}
+
+// Waits for the connection to break, even if it isn't used.
+func (p *peer) watch(pipe *pipeline) {
+	select {
+	case <-pipe.done:
+	case <-p.done:
+		return
+	}
+
+	select {
+	case <-p.done:
+		return
+	default:
+	}
+
+	p.logger.Outf(LOGLVL_WARNING, "[PEER] connection to %s lost: %s", p.raddr, pipe.lastErr().Error())
+
+	p.mutex.Lock()
+	p.state = PEERSTATE_RECONNECTING
+	p.mutex.Unlock()
+
+	p.reconnect()
+}
+
+func (p *peer) reconnect() {
+	delay := p.minBackoff
+	failures := 0
+
+	for {
+		select {
+		case <-time.After(delay):
+		case <-p.done:
+			return
+		}
+
+		pipe, err := p.dial()
+
+		if err == nil {
+			if !p.connected(pipe) {
+				return
+			}
+
+			p.logger.Outf(LOGLVL_INFO, "[PEER] reconnected to %s", p.raddr)
+
+			p.mutex.Lock()
+			onReconnect := p.onReconnect
+			p.mutex.Unlock()
+
+			if onReconnect != nil {
+				onReconnect()
+			}
+
+			return
+		}
+
+		failures++
+
+		p.logger.Outf(LOGLVL_ERROR, "[PEER] ERROR: reconnecting to %s: %s", p.raddr, err.Error())
+
+		if failures >= PEER_DOWN_AFTER {
+			p.mutex.Lock()
+			p.state = PEERSTATE_DOWN
+			p.mutex.Unlock()
+		}
+
+		delay *= 2
+
+		if delay > p.maxBackoff {
+			delay = p.maxBackoff
+		}
+	}
+}
+
+func (p *peer) close() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	select {
+	case <-p.done:
+		return nil
+	default:
+	}
+
+	close(p.done)
+	p.state = PEERSTATE_DOWN
+
+	return p.pipe.close()
+}
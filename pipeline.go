@@ -0,0 +1,312 @@
+package mydb
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Multiplexes requests over a single MessageConn. Every request gets
+// a fresh message id and responses are handed back to the waiting
+// caller by id, so any number of requests can be in flight at once.
+type pipeline struct {
+	mconn MessageConn
+	queue chan *QMessage
+	pending map[uint32]chan *QResult
+	// Requests given up on whose responses are still to come.
+	abandoned map[uint32]struct{}
+	lastId uint32
+	// Agreed on in the Hello exchange.
+	version uint16
+	caps uint32
+	err error
+	done chan struct{}
+	mutex *sync.Mutex
+}
+
+func newPipeline(mconn MessageConn) *pipeline {
+	p := &pipeline{
+		mconn: mconn,
+		queue: make(chan *QMessage, 64),
+		pending: make(map[uint32]chan *QResult),
+		abandoned: make(map[uint32]struct{}),
+		done: make(chan struct{}),
+		mutex: &sync.Mutex{},
+	}
+
+	go p.writeLoop()
+	go p.readLoop()
+
+	return p
+}
+
+// Connects to raddr (over TLS if tlsConfig is set), exchanges
+// Hellos and authenticates if a user is given.
+func dialPipeline(ctx context.Context, raddr string, tlsConfig *tls.Config, user string, token string) (*pipeline, error) {
+	dial := func() (*pipeline, error) {
+		var conn net.Conn
+		var err error
+
+		if tlsConfig != nil {
+			dialer := &tls.Dialer{Config: tlsConfig}
+			conn, err = dialer.DialContext(ctx, "tcp", raddr)
+		} else {
+			dialer := &net.Dialer{}
+			conn, err = dialer.DialContext(ctx, "tcp", raddr)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		return newPipeline(NewMessageConn(conn)), nil
+	}
+
+	pipe, err := dial()
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = hello(ctx, pipe)
+
+	if err != nil && ctx.Err() == nil && pipe.broken() {
+		// Servers older than the Hello hang up on it. Try again
+		// without.
+		pipe, err = dial()
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err != nil {
+		pipe.close()
+		return nil, err
+	}
+
+	if user != "" {
+		err = authenticate(ctx, pipe, user, token)
+
+		if err != nil {
+			pipe.close()
+			return nil, err
+		}
+	}
+
+	return pipe, nil
+}
+
+func (p *pipeline) String() string {
+	return fmt.Sprintf("%s", p.mconn)
+}
+
+// Sends the message with a new id and waits for the response. The
+// message passed in is not modified.
+func (p *pipeline) roundTrip(msg Message) (Message, error) {
+	return p.roundTripContext(context.Background(), msg)
+}
+
+// Like roundTrip but gives up once ctx is done. A response that
+// arrives later is dropped. Messages still queued then aren't sent
+// at all. Once a message is being written, ctx no longer matters:
+// cutting it off would break the connection for everybody else.
+func (p *pipeline) roundTripContext(ctx context.Context, msg Message) (Message, error) {
+	resultChan := make(chan *QResult, 1)
+
+	err := ctx.Err()
+
+	if err != nil {
+		return nil, err
+	}
+
+	p.mutex.Lock()
+
+	if p.err != nil {
+		err := p.err
+		p.mutex.Unlock()
+		return nil, err
+	}
+
+	if p.caps & requiredCap(msg) != requiredCap(msg) {
+		p.mutex.Unlock()
+		return nil, ErrUnsupported
+	}
+
+	p.lastId++
+
+	if p.lastId == 0 {
+		p.lastId++
+	}
+
+	mid := p.lastId
+	p.pending[mid] = resultChan
+
+	p.mutex.Unlock()
+
+	deadline, _ := ctx.Deadline()
+
+	select {
+	case p.queue <- &QMessage{Msg: withId(msg, mid), QResultChan: resultChan, Deadline: deadline}:
+	case <-p.done:
+	case <-ctx.Done():
+		p.abandon(mid, false)
+		return nil, ctx.Err()
+	}
+
+	// If the pipeline broke in the meantime fail() already
+	// delivered the error to us.
+	select {
+	case result := <-resultChan:
+		return result.Msg, result.Err
+	case <-ctx.Done():
+		p.abandon(mid, true)
+		return nil, ctx.Err()
+	}
+}
+
+// Forgets a pending request. If it was sent, its response is
+// expected and dropped when it arrives.
+func (p *pipeline) abandon(mid uint32, sent bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	_, ok := p.pending[mid]
+
+	if !ok {
+		// Response arrived or pipeline broke just now.
+		return
+	}
+
+	delete(p.pending, mid)
+
+	if sent {
+		p.abandoned[mid] = struct{}{}
+	}
+}
+
+// Whether a queued message is still to be sent. Requests given up on
+// or past their deadline while waiting in the queue are dropped.
+func (p *pipeline) claim(qmsg *QMessage) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	mid := qmsg.Msg.Id()
+
+	_, ok := p.pending[mid]
+
+	if !ok {
+		// Abandoned, no response will come.
+		delete(p.abandoned, mid)
+		return false
+	}
+
+	if !qmsg.Deadline.IsZero() && !time.Now().Before(qmsg.Deadline) {
+		delete(p.pending, mid)
+		qmsg.QResultChan <- &QResult{Err: context.DeadlineExceeded}
+		return false
+	}
+
+	return true
+}
+
+func (p *pipeline) writeLoop() {
+	for {
+		select {
+		case qmsg := <-p.queue:
+			if !p.claim(qmsg) {
+				continue
+			}
+
+			err := p.mconn.SendMessage(qmsg.Msg)
+
+			if err != nil {
+				p.fail(err)
+				return
+			}
+		case <-p.done:
+			return
+		}
+	}
+}
+
+func (p *pipeline) readLoop() {
+	for {
+		msg, err := p.mconn.ReadMessage()
+
+		if err != nil {
+			p.fail(err)
+			return
+		}
+
+		p.mutex.Lock()
+
+		resultChan, ok := p.pending[msg.Id()]
+		delete(p.pending, msg.Id())
+
+		_, abandoned := p.abandoned[msg.Id()]
+		delete(p.abandoned, msg.Id())
+
+		p.mutex.Unlock()
+
+		if abandoned {
+			continue
+		}
+
+		if !ok {
+			p.fail(fmt.Errorf("Received response with unknown message id %d.", msg.Id()))
+			return
+		}
+
+		resultChan <- &QResult{Msg: msg}
+	}
+}
+
+// Marks the pipeline as broken, fails all requests still waiting
+// for a response and closes the connection.
+func (p *pipeline) fail(err error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.err != nil {
+		return
+	}
+
+	p.err = err
+	close(p.done)
+
+	for mid, resultChan := range p.pending {
+		resultChan <- &QResult{Err: err}
+		delete(p.pending, mid)
+	}
+
+	p.mconn.Close()
+}
+
+func (p *pipeline) setCaps(version uint16, caps uint32) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.version = version
+	p.caps = caps
+}
+
+func (p *pipeline) broken() bool {
+	return p.lastErr() != nil
+}
+
+// Returns why the pipeline broke or nil if it is still usable.
+func (p *pipeline) lastErr() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.err
+}
+
+func (p *pipeline) close() error {
+	p.fail(fmt.Errorf("Connection closed."))
+	return nil
+}
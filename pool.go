@@ -0,0 +1,312 @@
+package mydb
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Keeps between minConns and maxConns connections to one server.
+// A request goes to an idle connection if there is one, then to a
+// new connection, and once maxConns are open it is pipelined onto
+// the connection with the fewest requests in flight.
+type connPool struct {
+	raddr string
+	dial func(ctx context.Context) (*pipeline, error)
+	minConns int
+	maxConns int
+	idleTimeout time.Duration
+	done chan struct{}
+
+	// Guard the fields below.
+	mutex *sync.Mutex
+	conns []*pooledConn
+	// Connections being dialed that count towards maxConns.
+	dialing int
+	closed bool
+}
+
+type pooledConn struct {
+	pipe *pipeline
+	inflight int
+	lastUsed time.Time
+}
+
+// Opens minConns connections, at least one. Fails if the first can't
+// be opened.
+func newConnPool(ctx context.Context, raddr string, dial func(ctx context.Context) (*pipeline, error), minConns int, maxConns int, idleTimeout time.Duration, healthCheck time.Duration) (*connPool, error) {
+	p := &connPool{
+		raddr: raddr,
+		dial: dial,
+		minConns: minConns,
+		maxConns: maxConns,
+		idleTimeout: idleTimeout,
+		done: make(chan struct{}),
+		mutex: &sync.Mutex{},
+	}
+
+	pipe, err := dial(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	p.conns = append(p.conns, &pooledConn{pipe: pipe, lastUsed: time.Now()})
+
+	p.fill()
+
+	go p.maintainLoop(healthCheck)
+
+	return p, nil
+}
+
+func (p *connPool) String() string {
+	return p.raddr
+}
+
+// Takes a connection for one request. Must be given back with release.
+func (p *connPool) acquire(ctx context.Context) (*pooledConn, error) {
+	p.mutex.Lock()
+
+	if p.closed {
+		p.mutex.Unlock()
+		return nil, fmt.Errorf("Connection pool of %s closed.", p.raddr)
+	}
+
+	p.pruneLocked()
+
+	var least *pooledConn = nil
+
+	for _, pc := range p.conns {
+		if least == nil || pc.inflight < least.inflight {
+			least = pc
+		}
+	}
+
+	if least != nil && (least.inflight == 0 || len(p.conns) + p.dialing >= p.maxConns) {
+		least.inflight++
+		p.mutex.Unlock()
+		return least, nil
+	}
+
+	p.dialing++
+	p.mutex.Unlock()
+
+	pipe, err := p.dial(ctx)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.dialing--
+
+	if err != nil {
+		// Rather share a connection than fail.
+		if least != nil && !least.pipe.broken() {
+			least.inflight++
+			return least, nil
+		}
+
+		return nil, err
+	}
+
+	if p.closed {
+		pipe.close()
+		return nil, fmt.Errorf("Connection pool of %s closed.", p.raddr)
+	}
+
+	pc := &pooledConn{pipe: pipe, inflight: 1}
+	p.conns = append(p.conns, pc)
+
+	return pc, nil
+}
+
+func (p *connPool) release(pc *pooledConn) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	pc.inflight--
+	pc.lastUsed = time.Now()
+}
+
+// Whether no usable connection is left.
+func (p *connPool) broken() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.pruneLocked()
+
+	return len(p.conns) == 0
+}
+
+// Drops connections that broke. Requests still in flight on them
+// have already failed.
+func (p *connPool) pruneLocked() {
+	conns := p.conns[:0]
+
+	for _, pc := range p.conns {
+		if !pc.pipe.broken() {
+			conns = append(conns, pc)
+		}
+	}
+
+	for i := len(conns); i < len(p.conns); i++ {
+		p.conns[i] = nil
+	}
+
+	p.conns = conns
+}
+
+// Closes connections that have been idle for too long, as long as
+// more than minConns are open.
+func (p *connPool) closeIdleLocked() {
+	now := time.Now()
+
+	conns := p.conns[:0]
+	open := len(p.conns)
+
+	for _, pc := range p.conns {
+		if open > p.minConns && pc.inflight == 0 && now.Sub(pc.lastUsed) > p.idleTimeout {
+			pc.pipe.close()
+			open--
+			continue
+		}
+
+		conns = append(conns, pc)
+	}
+
+	for i := len(conns); i < len(p.conns); i++ {
+		p.conns[i] = nil
+	}
+
+	p.conns = conns
+}
+
+// Opens connections until there are minConns.
+func (p *connPool) fill() {
+	for {
+		p.mutex.Lock()
+
+		if p.closed || len(p.conns) + p.dialing >= p.minConns {
+			p.mutex.Unlock()
+			return
+		}
+
+		p.dialing++
+		p.mutex.Unlock()
+
+		pipe, err := p.dial(context.Background())
+
+		p.mutex.Lock()
+
+		p.dialing--
+
+		if err != nil {
+			p.mutex.Unlock()
+			return
+		}
+
+		if p.closed {
+			p.mutex.Unlock()
+			pipe.close()
+			return
+		}
+
+		p.conns = append(p.conns, &pooledConn{pipe: pipe, lastUsed: time.Now()})
+
+		p.mutex.Unlock()
+	}
+}
+
+// Sends a Limits message over every idle connection and drops those
+// that don't answer within timeout. Catches connections that went
+// dead without the server closing them. Servers too old to answer
+// Limits can't be checked this way.
+func (p *connPool) ping(timeout time.Duration) {
+	p.mutex.Lock()
+
+	idle := make([]*pooledConn, 0, len(p.conns))
+
+	for _, pc := range p.conns {
+		if pc.inflight == 0 {
+			pc.inflight++
+			idle = append(idle, pc)
+		}
+	}
+
+	p.mutex.Unlock()
+
+	var wg sync.WaitGroup
+
+	for _, pc := range idle {
+		wg.Add(1)
+
+		go func(pc *pooledConn) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+
+			_, err := pc.pipe.roundTripContext(ctx, &Limits{})
+
+			if err != nil && err != ErrUnsupported {
+				pc.pipe.fail(fmt.Errorf("Health check failed: %s", err.Error()))
+			}
+
+			// Not a use, so idle connections still get closed.
+			p.mutex.Lock()
+			pc.inflight--
+			p.mutex.Unlock()
+		}(pc)
+	}
+
+	wg.Wait()
+}
+
+// Periodically checks the idle connections, drops broken and idle
+// ones and opens new ones to keep minConns.
+func (p *connPool) maintainLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+
+		p.mutex.Lock()
+		p.closeIdleLocked()
+		p.mutex.Unlock()
+
+		// Done before the next tick.
+		p.ping(interval)
+
+		p.mutex.Lock()
+		p.pruneLocked()
+		p.mutex.Unlock()
+
+		p.fill()
+	}
+}
+
+func (p *connPool) close() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.closed {
+		return nil
+	}
+
+	p.closed = true
+	close(p.done)
+
+	for _, pc := range p.conns {
+		pc.pipe.close()
+	}
+
+	p.conns = nil
+
+	return nil
+}
@@ -0,0 +1,506 @@
+package mydb
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Upper bound for the delay between two attempts to replicate
+// an operation.
+const MAX_REPLICATION_RETRY = 30 * time.Second
+
+// How many entries of a snapshot are in flight at the same time.
+const SNAPSHOT_WINDOW = 64
+
+// A replica starts out bootstrapping: it receives a full snapshot of
+// the storage while all writes are queued for it. Once the snapshot is
+// through the queue is replayed and a synchronous replica switches
+// over to receiving writes directly. The same happens again whenever
+// the connection to the replica is re-established, since the replica
+// may have lost data while it was gone.
+type replica struct {
+	raddr string
+	mode uint8
+	peer *peer
+	ops chan *replOp
+	inflight *replOp
+	retryDelay time.Duration
+	// Replicas are expected to accept frames as large as the
+	// master does.
+	maxFrameSize int
+	// Only changed with both the engine's write lock and mutex held.
+	bootstrapping bool
+	snapshotWanted bool
+	running bool
+	wake chan struct{}
+	storage Storage
+	wmutex *sync.Mutex
+	done chan struct{}
+	mutex *sync.Mutex
+	logger Logger
+}
+
+type replOp struct {
+	msg Message
+	queued time.Time
+}
+
+type ReplicaStats struct {
+	Addr string
+	Mode uint8
+
+	// Operations not yet acknowledged by the replica.
+	Queued int
+
+	// Age of the oldest operation not yet acknowledged.
+	OldestUnacked time.Duration
+
+	// Receiving a snapshot.
+	Bootstrapping bool
+
+	// One of PEERSTATE_*.
+	State uint8
+}
+
+// Must be called with the engine's write lock held, the snapshot
+// then contains every write not queued for the replica.
+func newReplica(raddr string, mode uint8, peer *peer, storage Storage, wmutex *sync.Mutex, queueSize int, retryDelay time.Duration, maxFrameSize int, logger Logger) *replica {
+	r := &replica{
+		raddr: raddr,
+		mode: mode,
+		peer: peer,
+		ops: make(chan *replOp, queueSize),
+		retryDelay: retryDelay,
+		maxFrameSize: maxFrameSize,
+		bootstrapping: true,
+		snapshotWanted: true,
+		running: true,
+		wake: make(chan struct{}, 1),
+		storage: storage,
+		wmutex: wmutex,
+		done: make(chan struct{}),
+		mutex: &sync.Mutex{},
+		logger: logger,
+	}
+
+	peer.setOnReconnect(r.resync)
+
+	go r.run()
+
+	return r
+}
+
+// Queues writes for the replica again and has it receive a new
+// snapshot.
+func (r *replica) resync() {
+	r.wmutex.Lock()
+	defer r.wmutex.Unlock()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.restart()
+}
+
+// Drops everything queued and has the replica receive a new snapshot
+// instead. Used when the queue runs full because the replica is gone
+// or can't keep up, so writes don't have to wait for it. Only called
+// with the engine's write lock held.
+func (r *replica) overflow() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.logger.Outf(LOGLVL_ERROR, "[REPLICA] ERROR: queue of %s is full, dropping it and sending a snapshot", r.raddr)
+
+	for len(r.ops) != 0 {
+		<-r.ops
+	}
+
+	r.restart()
+}
+
+// Must be called with both the engine's write lock and mutex held.
+func (r *replica) restart() {
+	r.bootstrapping = true
+	r.snapshotWanted = true
+
+	if !r.running {
+		r.running = true
+		go r.run()
+	} else {
+		select {
+		case r.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Whether writes go through the queue. Only called with the engine's
+// write lock held.
+func (r *replica) queueing() bool {
+	return r.bootstrapping || r.mode & REPLMODE_ASYNC != 0
+}
+
+// Only called with the engine's write lock held so nothing else
+// can fill the queue between full() and enqueue().
+func (r *replica) full() bool {
+	return len(r.ops) == cap(r.ops)
+}
+
+func (r *replica) enqueue(msg Message) {
+	r.ops <- &replOp{msg: msg, queued: time.Now()}
+}
+
+// Sends a single operation to the replica and checks the response.
+func (r *replica) send(msg Message) error {
+	rputMsg, isRPut := msg.(*RPut)
+
+	if isRPut && len(rputMsg.Keys) > 1 && rputPayloadSize(rputMsg) > r.maxFrameSize {
+		// Versions and expiry times make it larger than the
+		// batch it was made from.
+		for _, part := range splitRPut(rputMsg, r.maxFrameSize) {
+			err := r.send(part)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	retMsg, err := r.peer.roundTrip(msg)
+
+	code, isStatus := statusCode(retMsg)
+
+	if err == nil && isStatus && code == ERR_UNSUPPORTED {
+		// Servers not running as replica don't take RPut and
+		// Snapshot but can still be replicated to.
+		err = ErrUnsupported
+	}
+
+	if err == ErrUnsupported && isRPut {
+		// Replica doesn't know versions yet, it picks its own.
+		return r.send(&MPut{Keys: rputMsg.Keys, Values: rputMsg.Values})
+	}
+
+	mputMsg, isMPut := msg.(*MPut)
+
+	if err == ErrUnsupported && isMPut {
+		// Replica doesn't know batches yet.
+		for i, key := range mputMsg.Keys {
+			err = r.send(&Put{Key: key, Value: mputMsg.Values[i]})
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	switch retMsg.(type) {
+	case *MResult:
+		for _, status := range retMsg.(*MResult).Statuses {
+			if status != 0 {
+				return fmt.Errorf("Status code received was %d", status)
+			}
+		}
+	case *Status:
+		statusMsg := retMsg.(*Status)
+		if statusMsg.StatusCode != 0 {
+			return fmt.Errorf("Status code received was %d", statusMsg.StatusCode)
+		}
+	case *Error:
+		errorMsg := retMsg.(*Error)
+		return fmt.Errorf("Status code received was %d: %s", errorMsg.Code, errorMsg.Msg)
+	default:
+		return fmt.Errorf("Wrong message received.")
+	}
+
+	return nil
+}
+
+// Transfers the snapshot and then works through the queue in order.
+// Failed operations are retried with an increasing delay until the
+// replica acknowledges them.
+func (r *replica) run() {
+	for {
+		r.mutex.Lock()
+		snapshotWanted := r.snapshotWanted
+		r.snapshotWanted = false
+		r.mutex.Unlock()
+
+		if snapshotWanted && !r.snapshot() {
+			return
+		}
+
+		if r.goLive() {
+			return
+		}
+
+		select {
+		case <-r.wake:
+		case op := <-r.ops:
+			r.mutex.Lock()
+			r.inflight = op
+			r.mutex.Unlock()
+
+			delay := r.retryDelay
+
+			for {
+				err := r.send(op.msg)
+
+				if err == nil {
+					break
+				}
+
+				r.logger.Outf(LOGLVL_ERROR, "[REPLICA] ERROR: replicating to %s: %s", r.raddr, err.Error())
+
+				if !r.wait(&delay) {
+					return
+				}
+			}
+
+			r.mutex.Lock()
+			r.inflight = nil
+			r.mutex.Unlock()
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// Sends the snapshot until it goes through. Returns false if the
+// replica was stopped in the meantime.
+func (r *replica) snapshot() bool {
+	delay := r.retryDelay
+
+	for {
+		err := r.sendSnapshot()
+
+		if err == nil {
+			break
+		}
+
+		r.logger.Outf(LOGLVL_ERROR, "[REPLICA] ERROR: snapshot to %s: %s", r.raddr, err.Error())
+
+		if !r.wait(&delay) {
+			return false
+		}
+	}
+
+	r.logger.Outf(LOGLVL_INFO, "[REPLICA] snapshot to %s done", r.raddr)
+
+	return true
+}
+
+// Sleeps for the current retry delay and doubles it. Returns false
+// if the replica was stopped in the meantime.
+func (r *replica) wait(delay *time.Duration) bool {
+	select {
+	case <-time.After(*delay):
+	case <-r.done:
+		return false
+	}
+
+	*delay *= 2
+
+	if *delay > MAX_REPLICATION_RETRY {
+		*delay = MAX_REPLICATION_RETRY
+	}
+
+	return true
+}
+
+// Ends the bootstrap once the snapshot is through. A synchronous
+// replica is switched over to receiving writes directly once
+// everything queued in the meantime has been replayed, its worker
+// then isn't needed anymore and true is returned.
+func (r *replica) goLive() bool {
+	r.mutex.Lock()
+	bootstrapping := r.bootstrapping
+	r.mutex.Unlock()
+
+	if !bootstrapping {
+		return false
+	}
+
+	r.wmutex.Lock()
+	defer r.wmutex.Unlock()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.snapshotWanted {
+		return false
+	}
+
+	if r.mode & REPLMODE_ASYNC != 0 {
+		r.bootstrapping = false
+		return false
+	}
+
+	if len(r.ops) != 0 {
+		return false
+	}
+
+	r.bootstrapping = false
+	r.running = false
+
+	return true
+}
+
+// Sends every entry of the storage as an RPut. Replicas that
+// understand Snapshot messages then drop whatever else they have,
+// older ones keep entries deleted while they were gone.
+func (r *replica) sendSnapshot() error {
+	var wg sync.WaitGroup
+	var firstErr error
+	var errMutex sync.Mutex
+
+	err := r.send(&Snapshot{Phase: SNAPSHOT_BEGIN})
+	bracketed := err == nil
+
+	if err != nil && err != ErrUnsupported {
+		return err
+	}
+
+	window := make(chan struct{}, SNAPSHOT_WINDOW)
+
+	serr := r.storage.ForEach(func(key []byte, entry *Entry) bool {
+		errMutex.Lock()
+		failed := firstErr != nil
+		errMutex.Unlock()
+
+		if failed {
+			return false
+		}
+
+		window <- struct{}{}
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			err := r.send(&RPut{
+				Keys: [][]byte{key},
+				Values: [][]byte{entry.Value},
+				Versions: []uint64{entry.Version},
+				Expires: []time.Time{entry.Expires},
+			})
+
+			if err != nil {
+				errMutex.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				errMutex.Unlock()
+			}
+
+			<-window
+		}()
+
+		return true
+	})
+
+	wg.Wait()
+
+	if serr != nil {
+		return serr
+	}
+
+	if firstErr != nil || !bracketed {
+		return firstErr
+	}
+
+	return r.send(&Snapshot{Phase: SNAPSHOT_END})
+}
+
+// Size of the RPut's payload on the wire.
+func rputPayloadSize(rputMsg *RPut) int {
+	size := 4
+
+	for i, key := range rputMsg.Keys {
+		size += len(key) + 2 + 8 + 8 + len(rputMsg.Values[i]) + 4
+	}
+
+	return size
+}
+
+// Splits an RPut into parts whose payloads fit into maxFrameSize.
+// An entry too large on its own gets a part of its own.
+func splitRPut(rputMsg *RPut, maxFrameSize int) []*RPut {
+	var parts []*RPut
+
+	start := 0
+	size := 4
+
+	for i, key := range rputMsg.Keys {
+		entrySize := len(key) + 2 + 8 + 8 + len(rputMsg.Values[i]) + 4
+
+		if i > start && size + entrySize > maxFrameSize {
+			parts = append(parts, &RPut{
+				Keys: rputMsg.Keys[start:i],
+				Values: rputMsg.Values[start:i],
+				Versions: rputMsg.Versions[start:i],
+				Expires: rputMsg.Expires[start:i],
+			})
+
+			start = i
+			size = 4
+		}
+
+		size += entrySize
+	}
+
+	return append(parts, &RPut{
+		Keys: rputMsg.Keys[start:],
+		Values: rputMsg.Values[start:],
+		Versions: rputMsg.Versions[start:],
+		Expires: rputMsg.Expires[start:],
+	})
+}
+
+func (r *replica) stats() ReplicaStats {
+	stats := ReplicaStats{
+		Addr: r.raddr,
+		Mode: r.mode,
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	stats.Bootstrapping = r.bootstrapping
+	stats.State = r.peer.State()
+
+	stats.Queued = len(r.ops)
+
+	if r.inflight != nil {
+		stats.Queued++
+		stats.OldestUnacked = time.Since(r.inflight.queued)
+	}
+
+	return stats
+}
+
+// Stops the worker and closes the connection. Whatever is still
+// queued is dropped.
+func (r *replica) close() {
+	r.mutex.Lock()
+
+	select {
+	case <-r.done:
+	default:
+		close(r.done)
+	}
+
+	r.mutex.Unlock()
+
+	r.peer.close()
+}
@@ -0,0 +1,204 @@
+package mydb
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"time"
+)
+
+// Answers a Scan from the local storage. Lookup servers are not
+// asked. The page ends early if it would not fit into a message.
+func (de *DefaultEngine) scan(scanMsg *Scan) (Message, EngineError) {
+	ordered, ok := de.storage.(OrderedStorage)
+
+	if !ok {
+		return nil, EngineErrorf(ERR_UNSUPPORTED, "Storage can't scan.")
+	}
+
+	limit := int(scanMsg.Limit)
+
+	if limit == 0 || limit > de.config.MaxScanLimit {
+		limit = de.config.MaxScanLimit
+	}
+
+	start := scanMsg.Start
+
+	if bytes.Compare(scanMsg.Prefix, start) > 0 {
+		start = scanMsg.Prefix
+	}
+
+	resultMsg := &ScanResult{
+		MId: scanMsg.MId,
+		Keys: make([][]byte, 0),
+		Values: make([][]byte, 0),
+	}
+
+	// Header, more flag and count.
+	size := 9 + 1 + 4
+	now := time.Now()
+
+	it := ordered.NewIterator()
+	defer it.Close()
+
+	it.Seek(start)
+
+	for it.Next() {
+		key := it.Key()
+
+		if !bytes.HasPrefix(key, scanMsg.Prefix) {
+			break
+		}
+
+		if len(scanMsg.End) != 0 && bytes.Compare(key, scanMsg.End) >= 0 {
+			break
+		}
+
+		entry := it.Entry()
+
+		if entry.Expired(now) {
+			continue
+		}
+
+		entrySize := 2 + len(key) + 4 + len(entry.Value)
+
+		if len(resultMsg.Keys) == limit || (len(resultMsg.Keys) > 0 && size + entrySize > de.config.MaxFrameSize) {
+			resultMsg.More = true
+			break
+		}
+
+		resultMsg.Keys = append(resultMsg.Keys, key)
+		resultMsg.Values = append(resultMsg.Values, entry.Value)
+		size += entrySize
+	}
+
+	return resultMsg, nil
+}
+
+// Walks the result of a Scan, fetching a page at a time.
+//
+//	it := client.Scan(nil, nil, []byte("user/"), 0)
+//
+//	for it.Next() {
+//		fmt.Printf("%s = %s\n", it.Key(), it.Value())
+//	}
+//
+//	if it.Err() != nil {
+//		...
+//	}
+type ScanIterator struct {
+	c *Client
+	ctx context.Context
+	msg Scan
+	// Entries still to return, negative if unlimited.
+	remaining int
+	keys [][]byte
+	values [][]byte
+	pos int
+	more bool
+	key []byte
+	value []byte
+	err ClientError
+}
+
+// Iterates in key order over the entries from start up to but not
+// including end that start with prefix. An empty end means no upper
+// bound, a limit of zero or less no limit.
+func (c *Client) Scan(start []byte, end []byte, prefix []byte, limit int) *ScanIterator {
+	return c.ScanContext(context.Background(), start, end, prefix, limit)
+}
+
+// Like Scan but fetching pages gives up once ctx is done.
+func (c *Client) ScanContext(ctx context.Context, start []byte, end []byte, prefix []byte, limit int) *ScanIterator {
+	if limit <= 0 {
+		limit = -1
+	}
+
+	return &ScanIterator{
+		c: c,
+		ctx: ctx,
+		msg: Scan{Start: start, End: end, Prefix: prefix},
+		remaining: limit,
+		more: true,
+	}
+}
+
+// Moves to the next entry, fetching the next page if needed. Returns
+// false once there are no more entries or an error occurred.
+func (it *ScanIterator) Next() bool {
+	for it.pos == len(it.keys) {
+		if !it.more || it.err != nil || it.remaining == 0 {
+			return false
+		}
+
+		it.fetch()
+	}
+
+	if it.remaining == 0 {
+		return false
+	}
+
+	it.key = it.keys[it.pos]
+	it.value = it.values[it.pos]
+	it.pos++
+
+	if it.remaining > 0 {
+		it.remaining--
+	}
+
+	return true
+}
+
+func (it *ScanIterator) Key() []byte {
+	return it.key
+}
+
+func (it *ScanIterator) Value() []byte {
+	return it.value
+}
+
+// Why Next returned false, nil if the scan is complete.
+func (it *ScanIterator) Err() ClientError {
+	return it.err
+}
+
+func (it *ScanIterator) fetch() {
+	pageSize := it.c.config.ScanPageSize
+
+	if it.remaining > 0 && it.remaining < pageSize {
+		pageSize = it.remaining
+	}
+
+	scanMsg := it.msg
+	scanMsg.Limit = uint32(pageSize)
+
+	msg, err := it.c.read(it.ctx, &scanMsg)
+
+	if err != nil {
+		log.Printf("[CLIENT] ERROR: %s", err.Error())
+		it.err = requestError(err)
+		return
+	}
+
+	switch msg.(type) {
+	case *ScanResult:
+		resultMsg := msg.(*ScanResult)
+
+		it.keys = resultMsg.Keys
+		it.values = resultMsg.Values
+		it.pos = 0
+		it.more = resultMsg.More
+
+		if len(it.keys) > 0 {
+			// The next page starts right after the last key.
+			last := it.keys[len(it.keys) - 1]
+			it.msg.Start = append(append(make([]byte, 0, len(last) + 1), last...), 0)
+		} else {
+			it.more = false
+		}
+	case *Status, *Error:
+		it.err = serverError(msg)
+	default:
+		it.err = ClientErrorf("Server responded with wrong message type.")
+	}
+}
@@ -0,0 +1,918 @@
+package storage
+
+import (
+	. "github.com/FMNSSun/mydb"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sync the active data file after every write.
+const FSYNC_ALWAYS = uint8(0x01)
+
+// Sync the active data file periodically.
+const FSYNC_INTERVAL = uint8(0x02)
+
+// Leave syncing to the operating system.
+const FSYNC_NEVER = uint8(0x03)
+
+const DEFAULT_FSYNC_INTERVAL = 1 * time.Second
+const DEFAULT_MAX_FILE_SIZE = int64(64 * 1024 * 1024)
+const DEFAULT_COMPACT_INTERVAL = 10 * time.Minute
+const DEFAULT_COMPACT_RATIO = 0.5
+
+type DiskConfig struct {
+	// One of FSYNC_*. Defaults to FSYNC_INTERVAL.
+	SyncMode uint8
+	SyncInterval time.Duration
+
+	// Size at which a new data file is started.
+	MaxFileSize int64
+
+	// How often to check whether compaction is worth it and
+	// the share of stale bytes in the older data files above
+	// which they are compacted.
+	CompactInterval time.Duration
+	CompactRatio float64
+}
+
+// Record layout (little endian):
+//
+//   crc32 (4) | flags (1) | key length (2) | value length (4) | [version (8)] | [expires (8)] | key | value
+//
+// The checksum covers everything after itself. The version is there if
+// recordFlagVersion is set, records written before versions existed
+// are at version 1. The expiry time in nanoseconds since the epoch is
+// there if recordFlagExpires is set.
+const recordHeaderSize = 11
+
+const recordFlagTombstone = uint8(0x01)
+const recordFlagVersion = uint8(0x02)
+const recordFlagExpires = uint8(0x04)
+
+// Storage keeping its data in append-only files in a directory. Every
+// write is appended to the active data file, an in-memory directory
+// maps keys to the location of their latest value. Older data files
+// are never modified but rewritten without stale records once enough
+// of them is stale.
+type DiskStorage struct {
+	dir string
+	config DiskConfig
+	keydir map[KeyHash][]*diskEntry
+	files map[uint32]*dataFile
+	activeId uint32
+	// Serializes compactions with each other and with Close.
+	compactMutex *sync.Mutex
+	closed bool
+	closeOnce *sync.Once
+	mutex *sync.RWMutex
+	done chan struct{}
+	wg *sync.WaitGroup
+	logger Logger
+}
+
+type diskEntry struct {
+	key []byte
+	fileId uint32
+	offset int64
+	size int64
+	valueOffset int64
+	valueLen uint32
+	version uint64
+	expires time.Time
+}
+
+type dataFile struct {
+	f *os.File
+	size int64
+	// Bytes in records that have been superseded.
+	dead int64
+}
+
+func dataFileName(dir string, id uint32) string {
+	return filepath.Join(dir, fmt.Sprintf("%08d.data", id))
+}
+
+// Opens (or creates) the storage in dir. Records the last write may have
+// left incomplete are cut off.
+func OpenDiskStorage(dir string, config *DiskConfig, logger Logger) (*DiskStorage, error) {
+	cfg := *config
+
+	if cfg.SyncMode == 0 {
+		cfg.SyncMode = FSYNC_INTERVAL
+	}
+
+	if cfg.SyncInterval == 0 {
+		cfg.SyncInterval = DEFAULT_FSYNC_INTERVAL
+	}
+
+	if cfg.MaxFileSize == 0 {
+		cfg.MaxFileSize = DEFAULT_MAX_FILE_SIZE
+	}
+
+	if cfg.CompactInterval == 0 {
+		cfg.CompactInterval = DEFAULT_COMPACT_INTERVAL
+	}
+
+	if cfg.CompactRatio == 0 {
+		cfg.CompactRatio = DEFAULT_COMPACT_RATIO
+	}
+
+	err := os.MkdirAll(dir, 0755)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ds := &DiskStorage{
+		dir: dir,
+		config: cfg,
+		keydir: make(map[KeyHash][]*diskEntry),
+		files: make(map[uint32]*dataFile),
+		compactMutex: &sync.Mutex{},
+		closeOnce: &sync.Once{},
+		mutex: &sync.RWMutex{},
+		done: make(chan struct{}),
+		wg: &sync.WaitGroup{},
+		logger: logger,
+	}
+
+	ids, err := ds.listDataFiles()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for i, id := range ids {
+		err = ds.load(id, i == len(ids) - 1)
+
+		if err != nil {
+			ds.closeFiles()
+			return nil, err
+		}
+	}
+
+	if len(ids) == 0 {
+		err = ds.newActiveFile(1)
+
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		ds.activeId = ids[len(ids) - 1]
+	}
+
+	if cfg.SyncMode == FSYNC_INTERVAL {
+		ds.wg.Add(1)
+		go ds.syncLoop()
+	}
+
+	ds.wg.Add(1)
+	go ds.compactLoop()
+
+	return ds, nil
+}
+
+func (ds *DiskStorage) listDataFiles() ([]uint32, error) {
+	names, err := filepath.Glob(filepath.Join(ds.dir, "*.data"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]uint32, 0, len(names))
+
+	for _, name := range names {
+		id, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(name), ".data"), 10, 32)
+
+		if err != nil {
+			continue
+		}
+
+		ids = append(ids, uint32(id))
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	return ids, nil
+}
+
+// Replays a data file into the key directory. A broken record at the
+// end of the active file is what a crash in the middle of a write
+// leaves behind and is truncated. In older files everything from a
+// broken record on is ignored.
+func (ds *DiskStorage) load(id uint32, active bool) error {
+	f, err := os.OpenFile(dataFileName(ds.dir, id), os.O_RDWR, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	df := &dataFile{f: f}
+	ds.files[id] = df
+
+	stat, err := f.Stat()
+
+	if err != nil {
+		return err
+	}
+
+	r := io.NewSectionReader(f, 0, stat.Size())
+	offset := int64(0)
+
+	for {
+		flags, key, rec, err := readRecord(r, offset)
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			ds.logger.Outf(LOGLVL_WARNING, "[DISKSTORAGE] %s: broken record at %d: %s", f.Name(), offset, err.Error())
+
+			if active {
+				err = f.Truncate(offset)
+
+				if err != nil {
+					return err
+				}
+			}
+
+			break
+		}
+
+		if flags & recordFlagTombstone != 0 {
+			ds.remove(key)
+			df.dead += rec.size
+		} else {
+			rec.fileId = id
+			ds.set(rec)
+		}
+
+		offset += rec.size
+	}
+
+	df.size = offset
+
+	return nil
+}
+
+// Reads the record at offset, checks it and returns its flags, key
+// and where to find the value. The file id is left for the caller
+// to fill in.
+func readRecord(r *io.SectionReader, offset int64) (uint8, []byte, *diskEntry, error) {
+	header := make([]byte, recordHeaderSize)
+
+	n, err := r.ReadAt(header, offset)
+
+	if n == 0 && err == io.EOF {
+		return 0, nil, nil, io.EOF
+	}
+
+	if n != recordHeaderSize {
+		return 0, nil, nil, fmt.Errorf("Incomplete record header.")
+	}
+
+	crc := binary.LittleEndian.Uint32(header)
+	flags := header[4]
+	keyLen := int64(binary.LittleEndian.Uint16(header[5:]))
+	valueLen := binary.LittleEndian.Uint32(header[7:])
+	metaLen := int64(0)
+
+	if flags & recordFlagVersion != 0 {
+		metaLen += 8
+	}
+
+	if flags & recordFlagExpires != 0 {
+		metaLen += 8
+	}
+
+	if offset + recordHeaderSize + metaLen + keyLen + int64(valueLen) > r.Size() {
+		return 0, nil, nil, fmt.Errorf("Incomplete record.")
+	}
+
+	body := make([]byte, metaLen + keyLen + int64(valueLen))
+
+	n, _ = r.ReadAt(body, offset + recordHeaderSize)
+
+	if n != len(body) {
+		return 0, nil, nil, fmt.Errorf("Incomplete record.")
+	}
+
+	check := crc32.NewIEEE()
+	check.Write(header[4:])
+	check.Write(body)
+
+	if check.Sum32() != crc {
+		return 0, nil, nil, fmt.Errorf("Checksum mismatch.")
+	}
+
+	meta := body[:metaLen]
+	version := uint64(1)
+	expires := time.Time{}
+
+	if flags & recordFlagVersion != 0 {
+		version = binary.LittleEndian.Uint64(meta)
+		meta = meta[8:]
+	}
+
+	if flags & recordFlagExpires != 0 {
+		expires = time.Unix(0, int64(binary.LittleEndian.Uint64(meta)))
+	}
+
+	key := body[metaLen:metaLen + keyLen]
+
+	return flags, key, &diskEntry{
+		// Its own copy, the body holds the value as well.
+		key: append([]byte(nil), key...),
+		offset: offset,
+		size: recordHeaderSize + int64(len(body)),
+		valueOffset: offset + recordHeaderSize + metaLen + keyLen,
+		valueLen: valueLen,
+		version: version,
+		expires: expires,
+	}, nil
+}
+
+// Encodes a record carrying a version and, if there is one, the expiry
+// time. Tombstones carry neither.
+func encodeRecord(flags uint8, key []byte, value []byte, version uint64, expires time.Time) []byte {
+	metaLen := 0
+
+	if flags & recordFlagTombstone == 0 {
+		flags |= recordFlagVersion
+		metaLen += 8
+
+		if !expires.IsZero() {
+			flags |= recordFlagExpires
+			metaLen += 8
+		}
+	}
+
+	buf := make([]byte, recordHeaderSize + metaLen + len(key) + len(value))
+
+	buf[4] = flags
+	binary.LittleEndian.PutUint16(buf[5:], uint16(len(key)))
+	binary.LittleEndian.PutUint32(buf[7:], uint32(len(value)))
+
+	meta := buf[recordHeaderSize:]
+
+	if flags & recordFlagVersion != 0 {
+		binary.LittleEndian.PutUint64(meta, version)
+		meta = meta[8:]
+	}
+
+	if flags & recordFlagExpires != 0 {
+		binary.LittleEndian.PutUint64(meta, uint64(expires.UnixNano()))
+	}
+
+	copy(buf[recordHeaderSize + metaLen:], key)
+	copy(buf[recordHeaderSize + metaLen + len(key):], value)
+
+	binary.LittleEndian.PutUint32(buf, crc32.ChecksumIEEE(buf[4:]))
+
+	return buf
+}
+
+func (ds *DiskStorage) newActiveFile(id uint32) error {
+	f, err := os.OpenFile(dataFileName(ds.dir, id), os.O_RDWR | os.O_CREATE | os.O_EXCL, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	ds.files[id] = &dataFile{f: f}
+	ds.activeId = id
+
+	return nil
+}
+
+func (ds *DiskStorage) find(key []byte) *diskEntry {
+	for _, candidate := range ds.keydir[Hash(key)] {
+		if bytes.Equal(candidate.key, key) {
+			return candidate
+		}
+	}
+
+	return nil
+}
+
+// Points the key directory at a new record, accounting the
+// record it replaces as dead.
+func (ds *DiskStorage) set(entry *diskEntry) {
+	hash := Hash(entry.key)
+	entries := ds.keydir[hash]
+
+	for i, candidate := range entries {
+		if bytes.Equal(candidate.key, entry.key) {
+			ds.files[candidate.fileId].dead += candidate.size
+			entries[i] = entry
+			return
+		}
+	}
+
+	ds.keydir[hash] = append(entries, entry)
+}
+
+func (ds *DiskStorage) remove(key []byte) {
+	hash := Hash(key)
+	entries := ds.keydir[hash]
+
+	for i, candidate := range entries {
+		if bytes.Equal(candidate.key, key) {
+			ds.files[candidate.fileId].dead += candidate.size
+			entries = append(entries[:i], entries[i+1:]...)
+			break
+		}
+	}
+
+	if len(entries) == 0 {
+		delete(ds.keydir, hash)
+	} else {
+		ds.keydir[hash] = entries
+	}
+}
+
+// Appends a record to the active file, starting a new one if it
+// grew too big. Must be called with the lock held.
+func (ds *DiskStorage) append(flags uint8, key []byte, value []byte, version uint64, expires time.Time) (*diskEntry, error) {
+	active := ds.files[ds.activeId]
+
+	if active.size >= ds.config.MaxFileSize {
+		err := active.f.Sync()
+
+		if err != nil {
+			return nil, err
+		}
+
+		err = ds.newActiveFile(ds.activeId + 1)
+
+		if err != nil {
+			return nil, err
+		}
+
+		active = ds.files[ds.activeId]
+	}
+
+	record := encodeRecord(flags, key, value, version, expires)
+
+	_, err := active.f.WriteAt(record, active.size)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if ds.config.SyncMode == FSYNC_ALWAYS {
+		err = active.f.Sync()
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	entry := &diskEntry{
+		// The caller's key may share its array with the value.
+		key: append([]byte(nil), key...),
+		fileId: ds.activeId,
+		offset: active.size,
+		size: int64(len(record)),
+		valueOffset: active.size + int64(len(record) - len(value)),
+		valueLen: uint32(len(value)),
+		version: version,
+		expires: expires,
+	}
+
+	active.size += entry.size
+
+	return entry, nil
+}
+
+// Must be called with at least the read lock held.
+func (ds *DiskStorage) readValue(entry *diskEntry) ([]byte, error) {
+	value := make([]byte, entry.valueLen)
+
+	_, err := ds.files[entry.fileId].f.ReadAt(value, entry.valueOffset)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return value, nil
+}
+
+func (ds *DiskStorage) Get(key []byte) ([]byte, StorageError) {
+	entry, err := ds.GetEntry(key)
+
+	if entry == nil || entry.Expired(time.Now()) {
+		return nil, err
+	}
+
+	return entry.Value, nil
+}
+
+func (ds *DiskStorage) GetEntry(key []byte) (*Entry, StorageError) {
+	ds.logger.Outf(LOGLVL_INFO, "[DISKSTORAGE] Get: %x", key)
+
+	ds.mutex.RLock()
+	defer ds.mutex.RUnlock()
+
+	entry := ds.find(key)
+
+	if entry == nil {
+		return nil, nil
+	}
+
+	value, err := ds.readValue(entry)
+
+	if err != nil {
+		return nil, StorageErrorf2(ERR_STORAGE, err, "Could not read value.")
+	}
+
+	return &Entry{Value: value, Version: entry.version, Expires: entry.expires}, nil
+}
+
+func (ds *DiskStorage) Put(key []byte, value []byte) StorageError {
+	ds.logger.Outf(LOGLVL_INFO, "[DISKSTORAGE] Put: %x", key)
+
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+
+	version := uint64(1)
+	current := ds.find(key)
+
+	if current != nil {
+		version = current.version + 1
+	}
+
+	return ds.put(key, &Entry{Value: value, Version: version})
+}
+
+func (ds *DiskStorage) PutEntry(key []byte, entry *Entry) StorageError {
+	ds.logger.Outf(LOGLVL_INFO, "[DISKSTORAGE] Put: %x", key)
+
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+
+	return ds.put(key, entry)
+}
+
+// Must be called with the lock held.
+func (ds *DiskStorage) put(key []byte, entry *Entry) StorageError {
+	dentry, err := ds.append(0, key, entry.Value, entry.Version, entry.Expires)
+
+	if err != nil {
+		return StorageErrorf2(ERR_STORAGE, err, "Could not write record.")
+	}
+
+	ds.set(dentry)
+
+	return nil
+}
+
+func (ds *DiskStorage) Delete(key []byte) StorageError {
+	ds.logger.Outf(LOGLVL_INFO, "[DISKSTORAGE] Delete: %x", key)
+
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+
+	if ds.find(key) == nil {
+		return nil
+	}
+
+	entry, err := ds.append(recordFlagTombstone, key, nil, 0, time.Time{})
+
+	if err != nil {
+		return StorageErrorf2(ERR_STORAGE, err, "Could not write record.")
+	}
+
+	ds.files[entry.fileId].dead += entry.size
+	ds.remove(key)
+
+	return nil
+}
+
+// Goes by the key directory only, no values are read.
+func (ds *DiskStorage) ForEachExpiring(fn func(key []byte, expires time.Time) bool) StorageError {
+	ds.mutex.RLock()
+
+	entries := make([]diskEntry, 0)
+
+	for _, kentries := range ds.keydir {
+		for _, entry := range kentries {
+			if !entry.expires.IsZero() {
+				entries = append(entries, diskEntry{key: entry.key, expires: entry.expires})
+			}
+		}
+	}
+
+	ds.mutex.RUnlock()
+
+	for _, entry := range entries {
+		if !fn(entry.key, entry.expires) {
+			break
+		}
+	}
+
+	return nil
+}
+
+func (ds *DiskStorage) ForEach(fn func(key []byte, entry *Entry) bool) StorageError {
+	ds.mutex.RLock()
+
+	keys := make([][]byte, 0, len(ds.keydir))
+
+	for _, entries := range ds.keydir {
+		for _, entry := range entries {
+			keys = append(keys, entry.key)
+		}
+	}
+
+	ds.mutex.RUnlock()
+
+	for _, key := range keys {
+		ds.mutex.RLock()
+
+		entry := ds.find(key)
+
+		if entry == nil {
+			ds.mutex.RUnlock()
+			continue
+		}
+
+		value, err := ds.readValue(entry)
+		version := entry.version
+		expires := entry.expires
+
+		ds.mutex.RUnlock()
+
+		if err != nil {
+			return StorageErrorf2(ERR_STORAGE, err, "Could not read value.")
+		}
+
+		if !fn(key, &Entry{Value: value, Version: version, Expires: expires}) {
+			break
+		}
+	}
+
+	return nil
+}
+
+func (ds *DiskStorage) syncLoop() {
+	defer ds.wg.Done()
+
+	ticker := time.NewTicker(ds.config.SyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ds.mutex.RLock()
+			err := ds.files[ds.activeId].f.Sync()
+			ds.mutex.RUnlock()
+
+			if err != nil {
+				ds.logger.Outf(LOGLVL_ERROR, "[DISKSTORAGE] ERROR: sync: %s", err.Error())
+			}
+		case <-ds.done:
+			return
+		}
+	}
+}
+
+func (ds *DiskStorage) compactLoop() {
+	defer ds.wg.Done()
+
+	ticker := time.NewTicker(ds.config.CompactInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if !ds.compactionDue() {
+				continue
+			}
+
+			err := ds.Compact()
+
+			if err != nil {
+				ds.logger.Outf(LOGLVL_ERROR, "[DISKSTORAGE] ERROR: compaction: %s", err.Error())
+			}
+		case <-ds.done:
+			return
+		}
+	}
+}
+
+func (ds *DiskStorage) compactionDue() bool {
+	ds.mutex.RLock()
+	defer ds.mutex.RUnlock()
+
+	total := int64(0)
+	dead := int64(0)
+
+	for id, df := range ds.files {
+		if id == ds.activeId {
+			continue
+		}
+
+		total += df.size
+		dead += df.dead
+	}
+
+	return total > 0 && float64(dead) / float64(total) >= ds.config.CompactRatio
+}
+
+// Rewrites the live records of all data files but the active one into
+// a single new file and removes the old files. Writes continue to go to
+// a fresh active file in the meantime.
+func (ds *DiskStorage) Compact() StorageError {
+	ds.compactMutex.Lock()
+	defer ds.compactMutex.Unlock()
+
+	// The merged file is numbered below the new active file so that
+	// on recovery its records are replayed before the newer ones.
+	ds.mutex.Lock()
+
+	if len(ds.files) == 1 && ds.files[ds.activeId].size == 0 {
+		ds.mutex.Unlock()
+		return nil
+	}
+
+	mergeId := ds.activeId + 1
+
+	err := ds.files[ds.activeId].f.Sync()
+
+	if err == nil {
+		err = ds.newActiveFile(ds.activeId + 2)
+	}
+
+	if err != nil {
+		ds.mutex.Unlock()
+		return StorageErrorf2(ERR_STORAGE, err, "Could not start new data file.")
+	}
+
+	oldIds := make([]uint32, 0, len(ds.files))
+	// The files map changes under the lock when writes roll over to
+	// a new active file, so the old files are only reached through
+	// this copy until the lock is taken again.
+	oldFiles := make(map[uint32]*dataFile, len(ds.files))
+
+	for id, df := range ds.files {
+		if id != ds.activeId {
+			oldIds = append(oldIds, id)
+			oldFiles[id] = df
+		}
+	}
+
+	live := make([]*diskEntry, 0, len(ds.keydir))
+
+	for _, entries := range ds.keydir {
+		for _, entry := range entries {
+			if entry.fileId != ds.activeId {
+				live = append(live, entry)
+			}
+		}
+	}
+
+	ds.mutex.Unlock()
+
+	sort.Slice(oldIds, func(i, j int) bool { return oldIds[i] < oldIds[j] })
+
+	f, err := os.OpenFile(dataFileName(ds.dir, mergeId), os.O_RDWR | os.O_CREATE | os.O_EXCL, 0644)
+
+	if err != nil {
+		return StorageErrorf2(ERR_STORAGE, err, "Could not create merged data file.")
+	}
+
+	merged := &dataFile{f: f}
+	moved := make([]*diskEntry, len(live))
+
+	for i, entry := range live {
+		// Old files are never written to, reading them without
+		// the lock is fine.
+		value := make([]byte, entry.valueLen)
+
+		_, err = oldFiles[entry.fileId].f.ReadAt(value, entry.valueOffset)
+
+		if err != nil {
+			break
+		}
+
+		record := encodeRecord(0, entry.key, value, entry.version, entry.expires)
+
+		_, err = f.WriteAt(record, merged.size)
+
+		if err != nil {
+			break
+		}
+
+		moved[i] = &diskEntry{
+			// Already a copy of its own.
+			key: entry.key,
+			fileId: mergeId,
+			offset: merged.size,
+			size: int64(len(record)),
+			valueOffset: merged.size + int64(len(record) - len(value)),
+			valueLen: entry.valueLen,
+			version: entry.version,
+			expires: entry.expires,
+		}
+
+		merged.size += int64(len(record))
+	}
+
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return StorageErrorf2(ERR_STORAGE, err, "Could not write merged data file.")
+	}
+
+	ds.mutex.Lock()
+
+	ds.files[mergeId] = merged
+
+	for i, entry := range live {
+		current := ds.find(entry.key)
+
+		if current == entry {
+			ds.set(moved[i])
+			// set() accounted the old record as dead but
+			// the old file is going away anyway.
+		} else {
+			merged.dead += moved[i].size
+		}
+	}
+
+	for _, id := range oldIds {
+		delete(ds.files, id)
+	}
+
+	ds.mutex.Unlock()
+
+	// Oldest first: if we crash in between, a tombstone dropped by the
+	// merge is never gone while a record it deleted is still around.
+	for _, id := range oldIds {
+		df := oldFiles[id]
+		df.f.Close()
+
+		err = os.Remove(df.f.Name())
+
+		if err != nil {
+			ds.logger.Outf(LOGLVL_ERROR, "[DISKSTORAGE] ERROR: %s", err.Error())
+		}
+	}
+
+	ds.logger.Outf(LOGLVL_INFO, "[DISKSTORAGE] compacted %d files into %s", len(oldIds), f.Name())
+
+	return nil
+}
+
+// Stops the background work, syncs and closes all data files.
+func (ds *DiskStorage) Close() StorageError {
+	ds.closeOnce.Do(func() {
+		close(ds.done)
+	})
+
+	ds.wg.Wait()
+
+	ds.compactMutex.Lock()
+	defer ds.compactMutex.Unlock()
+
+	if ds.closed {
+		return nil
+	}
+
+	ds.closed = true
+
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+
+	err := ds.files[ds.activeId].f.Sync()
+
+	ds.closeFiles()
+
+	if err != nil {
+		return StorageErrorf2(ERR_STORAGE, err, "Could not sync data file.")
+	}
+
+	return nil
+}
+
+func (ds *DiskStorage) closeFiles() {
+	for _, df := range ds.files {
+		df.f.Close()
+	}
+}
@@ -0,0 +1,241 @@
+package storage
+
+import (
+	. "github.com/FMNSSun/mydb"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func openTestDisk(t *testing.T, dir string, maxFileSize int64) *DiskStorage {
+	ds, err := OpenDiskStorage(dir, &DiskConfig{SyncMode: FSYNC_NEVER, MaxFileSize: maxFileSize}, NewLogger(io.Discard, ""))
+
+	if err != nil {
+		t.Fatalf("open: %s", err.Error())
+	}
+
+	return ds
+}
+
+func expectValue(t *testing.T, ds *DiskStorage, key string, value string) {
+	t.Helper()
+
+	got, err := ds.Get([]byte(key))
+
+	if err != nil {
+		t.Fatalf("get %s: %s", key, err.Error())
+	}
+
+	if value == "" && got != nil {
+		t.Fatalf("get %s: expected nothing, got %q", key, got)
+	}
+
+	if value != "" && !bytes.Equal(got, []byte(value)) {
+		t.Fatalf("get %s: expected %q, got %q", key, value, got)
+	}
+}
+
+func TestDiskTruncatesBrokenRecord(t *testing.T) {
+	dir := t.TempDir()
+
+	ds := openTestDisk(t, dir, 0)
+	ds.Put([]byte("a"), []byte("1"))
+	ds.Put([]byte("b"), []byte("2"))
+	ds.Close()
+
+	name := dataFileName(dir, 1)
+
+	stat, err := os.Stat(name)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// What a crash in the middle of writing a record leaves behind.
+	partial := encodeRecord(0, []byte("c"), []byte("3"), 1, time.Time{})
+
+	f, err := os.OpenFile(name, os.O_WRONLY | os.O_APPEND, 0644)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.Write(partial[:len(partial) - 1])
+	f.Close()
+
+	ds = openTestDisk(t, dir, 0)
+
+	expectValue(t, ds, "a", "1")
+	expectValue(t, ds, "b", "2")
+	expectValue(t, ds, "c", "")
+
+	if ds.files[1].size != stat.Size() {
+		t.Fatalf("expected active file cut back to %d bytes, is %d", stat.Size(), ds.files[1].size)
+	}
+
+	ds.Put([]byte("d"), []byte("4"))
+	ds.Close()
+
+	ds = openTestDisk(t, dir, 0)
+	defer ds.Close()
+
+	expectValue(t, ds, "d", "4")
+}
+
+func TestDiskReplaysTombstones(t *testing.T) {
+	dir := t.TempDir()
+
+	// Small files so the delete lands in a later file than the put.
+	ds := openTestDisk(t, dir, 64)
+	ds.Put([]byte("gone"), []byte("value"))
+	ds.Put([]byte("kept"), []byte("value"))
+
+	for i := 0; i < 10; i++ {
+		ds.Put([]byte(fmt.Sprintf("filler%d", i)), []byte("value"))
+	}
+
+	ds.Delete([]byte("gone"))
+	ds.Close()
+
+	ds = openTestDisk(t, dir, 64)
+	defer ds.Close()
+
+	if len(ds.files) < 2 {
+		t.Fatalf("expected several data files, got %d", len(ds.files))
+	}
+
+	expectValue(t, ds, "gone", "")
+	expectValue(t, ds, "kept", "value")
+}
+
+func TestDiskCompaction(t *testing.T) {
+	dir := t.TempDir()
+
+	ds := openTestDisk(t, dir, 64)
+
+	for i := 0; i < 20; i++ {
+		ds.Put([]byte(fmt.Sprintf("key%d", i % 5)), []byte(fmt.Sprintf("value%d", i)))
+	}
+
+	ds.Delete([]byte("key0"))
+
+	serr := ds.Compact()
+
+	if serr != nil {
+		t.Fatalf("compact: %s", serr.Error())
+	}
+
+	// Writes after the compaction go to files numbered above the
+	// merged one and have to win on recovery.
+	ds.Put([]byte("key1"), []byte("after"))
+	ds.Delete([]byte("key2"))
+	ds.Close()
+
+	ds = openTestDisk(t, dir, 64)
+	defer ds.Close()
+
+	expectValue(t, ds, "key0", "")
+	expectValue(t, ds, "key1", "after")
+	expectValue(t, ds, "key2", "")
+	expectValue(t, ds, "key3", "value18")
+	expectValue(t, ds, "key4", "value19")
+
+	entry, _ := ds.GetEntry([]byte("key3"))
+
+	if entry.Version != 4 {
+		t.Fatalf("expected version 4 to survive compaction, got %d", entry.Version)
+	}
+}
+
+func TestDiskCompactionWhileWriting(t *testing.T) {
+	ds := openTestDisk(t, t.TempDir(), 128)
+	defer ds.Close()
+
+	for i := 0; i < 50; i++ {
+		ds.Put([]byte(fmt.Sprintf("key%d", i)), []byte("value"))
+	}
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		// Rolls over to new active files all the time.
+		for i := 0; i < 500; i++ {
+			ds.Put([]byte(fmt.Sprintf("key%d", i % 50)), []byte(fmt.Sprintf("value%d", i)))
+		}
+	}()
+
+	for i := 0; i < 5; i++ {
+		serr := ds.Compact()
+
+		if serr != nil {
+			t.Fatalf("compact: %s", serr.Error())
+		}
+	}
+
+	wg.Wait()
+
+	for i := 0; i < 50; i++ {
+		expectValue(t, ds, fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", 450 + i))
+	}
+}
+
+func TestDiskKeysDontHoldValues(t *testing.T) {
+	dir := t.TempDir()
+
+	ds := openTestDisk(t, dir, 0)
+
+	// Like a Put straight out of a message payload.
+	payload := make([]byte, 3 + 1024 * 1024)
+	copy(payload, "key")
+	ds.Put(payload[:3], payload[3:])
+
+	entry := ds.find([]byte("key"))
+
+	if cap(entry.key) > 64 {
+		t.Fatalf("key keeps the value alive (cap %d)", cap(entry.key))
+	}
+
+	ds.Close()
+
+	ds = openTestDisk(t, dir, 0)
+	defer ds.Close()
+
+	entry = ds.find([]byte("key"))
+
+	if cap(entry.key) > 64 {
+		t.Fatalf("key keeps the value alive after recovery (cap %d)", cap(entry.key))
+	}
+}
+
+func TestDiskForEachExpiring(t *testing.T) {
+	ds := openTestDisk(t, t.TempDir(), 0)
+	defer ds.Close()
+
+	expires := time.Now().Add(time.Hour).Round(0)
+
+	ds.Put([]byte("forever"), []byte("value"))
+	ds.PutEntry([]byte("expiring"), &Entry{Value: []byte("value"), Version: 1, Expires: expires})
+
+	var keys []string
+
+	ds.ForEachExpiring(func(key []byte, at time.Time) bool {
+		if !at.Equal(expires) {
+			t.Fatalf("expected %s to expire at %s, got %s", key, expires, at)
+		}
+
+		keys = append(keys, string(key))
+		return true
+	})
+
+	if len(keys) != 1 || keys[0] != "expiring" {
+		t.Fatalf("expected only the expiring entry, got %v", keys)
+	}
+}
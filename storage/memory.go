@@ -4,6 +4,7 @@ import (
 	. "github.com/FMNSSun/mydb"
 	"sync"
 	"bytes"
+	"time"
 )
 
 type MemoryStorage struct {
@@ -15,6 +16,8 @@ type MemoryStorage struct {
 type kv struct {
 	key []byte
 	value []byte
+	version uint64
+	expires time.Time
 }
 
 func NewMemoryStorage(logger Logger) Storage {
@@ -26,48 +29,159 @@ func NewMemoryStorage(logger Logger) Storage {
 }
 
 func (m *MemoryStorage) Get(key []byte) ([]byte, StorageError) {
+	entry, err := m.GetEntry(key)
+
+	if entry == nil || entry.Expired(time.Now()) {
+		return nil, err
+	}
+
+	return entry.Value, nil
+}
+
+func (m *MemoryStorage) GetEntry(key []byte) (*Entry, StorageError) {
 	m.logger.Outf(LOGLVL_INFO, "[MEMORYSTORAGE] Get: %x", key)
 
 	m.mutex.RLock()
+	defer m.mutex.RUnlock()
 
-	val, ok := m.m[Hash(key)]
+	candidate := m.find(key)
 
-	m.mutex.RUnlock()
-
-	if !ok {
+	if candidate == nil {
 		return nil, nil
 	}
 
-	for _, candidate := range val {
+	return &Entry{Value: candidate.value, Version: candidate.version, Expires: candidate.expires}, nil
+}
+
+func (m *MemoryStorage) Put(key []byte, value []byte) StorageError {
+	m.logger.Outf(LOGLVL_INFO, "[MEMORYSTORAGE] Put: %x", key)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	version := uint64(1)
+	candidate := m.find(key)
+
+	if candidate != nil {
+		version = candidate.version + 1
+	}
+
+	m.set(key, &Entry{Value: value, Version: version})
+
+	return nil
+}
+
+func (m *MemoryStorage) PutEntry(key []byte, entry *Entry) StorageError {
+	m.logger.Outf(LOGLVL_INFO, "[MEMORYSTORAGE] Put: %x", key)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.set(key, entry)
+
+	return nil
+}
+
+// Must be called with at least the read lock held.
+func (m *MemoryStorage) find(key []byte) *kv {
+	for _, candidate := range m.m[Hash(key)] {
 		if bytes.Equal(candidate.key, key) {
-			return candidate.value, nil
+			return candidate
 		}
 	}
 
-	return nil, StorageErrorf(ERR_NOTEXISTS, "Entry does not exist.")
+	return nil
 }
 
-func (m *MemoryStorage) Put(key []byte, value []byte) StorageError {
-	m.logger.Outf(LOGLVL_INFO, "[MEMORYSTORAGE] Put: %x", key)
+// Must be called with the lock held.
+func (m *MemoryStorage) set(key []byte, entry *Entry) {
+	candidate := m.find(key)
+
+	if candidate != nil {
+		candidate.value = entry.Value
+		candidate.version = entry.Version
+		candidate.expires = entry.Expires
+		return
+	}
+
+	hash := Hash(key)
+	m.m[hash] = append(m.m[hash], &kv{key: key, value: entry.Value, version: entry.Version, expires: entry.Expires})
+}
+
+func (m *MemoryStorage) Delete(key []byte) StorageError {
+	m.logger.Outf(LOGLVL_INFO, "[MEMORYSTORAGE] Delete: %x", key)
 
 	m.mutex.Lock()
 
-	val, ok := m.m[Hash(key)]
+	hash := Hash(key)
+	val, ok := m.m[hash]
 
-	if !ok {
-		kvs := make([]*kv, 1)
-		kvs[0] = &kv{key: key, value: value}
-		m.m[Hash(key)] = kvs
-	} else {
-		for _, candidate := range val {
+	if ok {
+		for i, candidate := range val {
 			if bytes.Equal(candidate.key, key) {
-				candidate.value = value
+				val = append(val[:i], val[i+1:]...)
 				break
 			}
 		}
+
+		if len(val) == 0 {
+			delete(m.m, hash)
+		} else {
+			m.m[hash] = val
+		}
 	}
 
 	m.mutex.Unlock()
 
 	return nil
 }
+
+func (m *MemoryStorage) ForEach(fn func(key []byte, entry *Entry) bool) StorageError {
+	m.mutex.RLock()
+
+	entries := make([]kv, 0, len(m.m))
+
+	for _, kvs := range m.m {
+		for _, entry := range kvs {
+			entries = append(entries, *entry)
+		}
+	}
+
+	m.mutex.RUnlock()
+
+	for _, entry := range entries {
+		if !fn(entry.key, &Entry{Value: entry.value, Version: entry.version, Expires: entry.expires}) {
+			break
+		}
+	}
+
+	return nil
+}
+
+func (m *MemoryStorage) ForEachExpiring(fn func(key []byte, expires time.Time) bool) StorageError {
+	m.mutex.RLock()
+
+	entries := make([]kv, 0)
+
+	for _, kvs := range m.m {
+		for _, entry := range kvs {
+			if !entry.expires.IsZero() {
+				entries = append(entries, kv{key: entry.key, expires: entry.expires})
+			}
+		}
+	}
+
+	m.mutex.RUnlock()
+
+	for _, entry := range entries {
+		if !fn(entry.key, entry.expires) {
+			break
+		}
+	}
+
+	return nil
+}
+
+func (m *MemoryStorage) Close() StorageError {
+	return nil
+}
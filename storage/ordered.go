@@ -0,0 +1,300 @@
+package storage
+
+import (
+	. "github.com/FMNSSun/mydb"
+	"bytes"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const skipListMaxLevel = 24
+
+// One in skipListBranching nodes of a level is on the next level too.
+const skipListBranching = 4
+
+// In-memory storage keeping its entries sorted by key in a skip list.
+// Slower than MemoryStorage for single keys but can be scanned.
+type OrderedMemoryStorage struct {
+	head *skipNode
+	level int
+	rnd *rand.Rand
+	mutex *sync.RWMutex
+	logger Logger
+}
+
+type skipNode struct {
+	key []byte
+	value []byte
+	version uint64
+	expires time.Time
+	next []*skipNode
+}
+
+type orderedIterator struct {
+	s *OrderedMemoryStorage
+	// Where the next call to Next continues.
+	from []byte
+	inclusive bool
+	key []byte
+	entry *Entry
+}
+
+func NewOrderedMemoryStorage(logger Logger) OrderedStorage {
+	return &OrderedMemoryStorage{
+		head: &skipNode{next: make([]*skipNode, skipListMaxLevel)},
+		level: 1,
+		rnd: rand.New(rand.NewSource(time.Now().UnixNano())),
+		mutex: &sync.RWMutex{},
+		logger: logger,
+	}
+}
+
+// The first node with a key not less than key, or greater than key if
+// not inclusive. If update is not nil it receives the last node before
+// that on every level. Must be called with at least the read lock held.
+func (o *OrderedMemoryStorage) seek(key []byte, inclusive bool, update []*skipNode) *skipNode {
+	x := o.head
+
+	for lvl := o.level - 1; lvl >= 0; lvl-- {
+		for x.next[lvl] != nil {
+			cmp := bytes.Compare(x.next[lvl].key, key)
+
+			if cmp > 0 || (cmp == 0 && inclusive) {
+				break
+			}
+
+			x = x.next[lvl]
+		}
+
+		if update != nil {
+			update[lvl] = x
+		}
+	}
+
+	return x.next[0]
+}
+
+// Must be called with the lock held.
+func (o *OrderedMemoryStorage) randomLevel() int {
+	level := 1
+
+	for level < skipListMaxLevel && o.rnd.Intn(skipListBranching) == 0 {
+		level++
+	}
+
+	return level
+}
+
+// Must be called with the lock held.
+func (o *OrderedMemoryStorage) set(key []byte, entry *Entry) {
+	update := make([]*skipNode, skipListMaxLevel)
+
+	x := o.seek(key, true, update)
+
+	if x != nil && bytes.Equal(x.key, key) {
+		x.value = entry.Value
+		x.version = entry.Version
+		x.expires = entry.Expires
+		return
+	}
+
+	level := o.randomLevel()
+
+	if level > o.level {
+		for lvl := o.level; lvl < level; lvl++ {
+			update[lvl] = o.head
+		}
+
+		o.level = level
+	}
+
+	x = &skipNode{
+		key: key,
+		value: entry.Value,
+		version: entry.Version,
+		expires: entry.Expires,
+		next: make([]*skipNode, level),
+	}
+
+	for lvl := 0; lvl < level; lvl++ {
+		x.next[lvl] = update[lvl].next[lvl]
+		update[lvl].next[lvl] = x
+	}
+}
+
+// Must be called with at least the read lock held.
+func (o *OrderedMemoryStorage) find(key []byte) *skipNode {
+	x := o.seek(key, true, nil)
+
+	if x != nil && bytes.Equal(x.key, key) {
+		return x
+	}
+
+	return nil
+}
+
+func (o *OrderedMemoryStorage) Get(key []byte) ([]byte, StorageError) {
+	entry, err := o.GetEntry(key)
+
+	if entry == nil || entry.Expired(time.Now()) {
+		return nil, err
+	}
+
+	return entry.Value, nil
+}
+
+func (o *OrderedMemoryStorage) GetEntry(key []byte) (*Entry, StorageError) {
+	o.logger.Outf(LOGLVL_INFO, "[ORDEREDSTORAGE] Get: %x", key)
+
+	o.mutex.RLock()
+	defer o.mutex.RUnlock()
+
+	x := o.find(key)
+
+	if x == nil {
+		return nil, nil
+	}
+
+	return &Entry{Value: x.value, Version: x.version, Expires: x.expires}, nil
+}
+
+func (o *OrderedMemoryStorage) Put(key []byte, value []byte) StorageError {
+	o.logger.Outf(LOGLVL_INFO, "[ORDEREDSTORAGE] Put: %x", key)
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	version := uint64(1)
+	x := o.find(key)
+
+	if x != nil {
+		version = x.version + 1
+	}
+
+	o.set(key, &Entry{Value: value, Version: version})
+
+	return nil
+}
+
+func (o *OrderedMemoryStorage) PutEntry(key []byte, entry *Entry) StorageError {
+	o.logger.Outf(LOGLVL_INFO, "[ORDEREDSTORAGE] Put: %x", key)
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	o.set(key, entry)
+
+	return nil
+}
+
+func (o *OrderedMemoryStorage) Delete(key []byte) StorageError {
+	o.logger.Outf(LOGLVL_INFO, "[ORDEREDSTORAGE] Delete: %x", key)
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	update := make([]*skipNode, skipListMaxLevel)
+
+	x := o.seek(key, true, update)
+
+	if x == nil || !bytes.Equal(x.key, key) {
+		return nil
+	}
+
+	for lvl := 0; lvl < len(x.next); lvl++ {
+		update[lvl].next[lvl] = x.next[lvl]
+	}
+
+	for o.level > 1 && o.head.next[o.level - 1] == nil {
+		o.level--
+	}
+
+	return nil
+}
+
+// Calls fn in key order.
+func (o *OrderedMemoryStorage) ForEach(fn func(key []byte, entry *Entry) bool) StorageError {
+	it := o.NewIterator()
+	defer it.Close()
+
+	for it.Next() {
+		if !fn(it.Key(), it.Entry()) {
+			break
+		}
+	}
+
+	return nil
+}
+
+func (o *OrderedMemoryStorage) ForEachExpiring(fn func(key []byte, expires time.Time) bool) StorageError {
+	o.mutex.RLock()
+
+	nodes := make([]skipNode, 0)
+
+	for node := o.head.next[0]; node != nil; node = node.next[0] {
+		if !node.expires.IsZero() {
+			nodes = append(nodes, skipNode{key: node.key, expires: node.expires})
+		}
+	}
+
+	o.mutex.RUnlock()
+
+	for _, node := range nodes {
+		if !fn(node.key, node.expires) {
+			break
+		}
+	}
+
+	return nil
+}
+
+func (o *OrderedMemoryStorage) NewIterator() Iterator {
+	return &orderedIterator{
+		s: o,
+		inclusive: true,
+	}
+}
+
+func (o *OrderedMemoryStorage) Close() StorageError {
+	return nil
+}
+
+func (it *orderedIterator) Seek(key []byte) {
+	it.from = key
+	it.inclusive = true
+}
+
+// Looks up the successor of the current key every time so entries
+// deleted in the meantime don't get in the way.
+func (it *orderedIterator) Next() bool {
+	it.s.mutex.RLock()
+	defer it.s.mutex.RUnlock()
+
+	x := it.s.seek(it.from, it.inclusive, nil)
+
+	if x == nil {
+		it.key = nil
+		it.entry = nil
+		return false
+	}
+
+	it.key = x.key
+	it.entry = &Entry{Value: x.value, Version: x.version, Expires: x.expires}
+	it.from = x.key
+	it.inclusive = false
+
+	return true
+}
+
+func (it *orderedIterator) Key() []byte {
+	return it.key
+}
+
+func (it *orderedIterator) Entry() *Entry {
+	return it.entry
+}
+
+func (it *orderedIterator) Close() StorageError {
+	return nil
+}
@@ -0,0 +1,234 @@
+package mydb_test
+
+import (
+	. "github.com/FMNSSun/mydb"
+	"github.com/FMNSSun/mydb/storage"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// A self-signed certificate for 127.0.0.1 usable by both ends and the
+// pool trusting it.
+func selfSigned(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{CommonName: "mydb test"},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().Add(time.Hour),
+		IsCA: true,
+		BasicConstraintsValid: true,
+		KeyUsage: x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, pool
+}
+
+// Starts an engine serving TLS and waits until it accepts connections.
+func serveTLS(t *testing.T, config *tls.Config, engineConfig *EngineConfig) (Engine, string) {
+	logger := NewLogger(io.Discard, "")
+	engine := NewEngineWithConfig(storage.NewMemoryStorage(logger), logger, engineConfig)
+
+	return engine, serve(t, engine, config)
+}
+
+func TestTLSClient(t *testing.T) {
+	cert, pool := selfSigned(t)
+
+	engine, addr := serveTLS(t, &tls.Config{Certificates: []tls.Certificate{cert}}, &EngineConfig{})
+	defer engine.Close()
+
+	client, err := NewClientWithConfig(addr, &ClientConfig{TLS: &tls.Config{RootCAs: pool}})
+
+	if err != nil {
+		t.Fatalf("connect: %s", err.Error())
+	}
+
+	defer client.Close()
+
+	cerr := client.Put([]byte("key"), []byte("value"))
+
+	if cerr != nil {
+		t.Fatalf("put: %s", cerr.Error())
+	}
+
+	value, cerr := client.Get([]byte("key"))
+
+	if cerr != nil || !bytes.Equal(value, []byte("value")) {
+		t.Fatalf("get: %q %v", value, cerr)
+	}
+}
+
+func TestTLSUntrustedServer(t *testing.T) {
+	cert, _ := selfSigned(t)
+	_, otherPool := selfSigned(t)
+
+	engine, addr := serveTLS(t, &tls.Config{Certificates: []tls.Certificate{cert}}, &EngineConfig{})
+	defer engine.Close()
+
+	_, err := DialMessageConnTLS(addr, &tls.Config{RootCAs: otherPool})
+
+	if err == nil {
+		t.Fatalf("expected the handshake to fail")
+	}
+}
+
+func TestTLSMessageConn(t *testing.T) {
+	cert, pool := selfSigned(t)
+
+	engine, addr := serveTLS(t, &tls.Config{Certificates: []tls.Certificate{cert}}, &EngineConfig{})
+	defer engine.Close()
+
+	mconn, err := DialMessageConnTLS(addr, &tls.Config{RootCAs: pool})
+
+	if err != nil {
+		t.Fatalf("dial: %s", err.Error())
+	}
+
+	defer mconn.Close()
+
+	err = mconn.SendMessage(&Put{MId: 1, Key: []byte("key"), Value: []byte("value")})
+
+	if err != nil {
+		t.Fatalf("send: %s", err.Error())
+	}
+
+	msg, err := mconn.ReadMessage()
+
+	if err != nil {
+		t.Fatalf("read: %s", err.Error())
+	}
+
+	statusMsg, ok := msg.(*Status)
+
+	if !ok || statusMsg.MId != 1 || statusMsg.StatusCode != 0 {
+		t.Fatalf("expected a successful Status, got %s", msg)
+	}
+}
+
+func TestTLSClientCertRequired(t *testing.T) {
+	cert, pool := selfSigned(t)
+
+	engine, addr := serveTLS(t, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs: pool,
+	}, &EngineConfig{})
+	defer engine.Close()
+
+	client, err := NewClientWithConfig(addr, &ClientConfig{TLS: &tls.Config{RootCAs: pool}})
+
+	if err == nil {
+		cerr := client.Put([]byte("key"), []byte("value"))
+		client.Close()
+
+		if cerr == nil {
+			t.Fatalf("expected a client without certificate to be refused")
+		}
+	}
+
+	client, err = NewClientWithConfig(addr, &ClientConfig{TLS: &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{cert}}})
+
+	if err != nil {
+		t.Fatalf("connect with certificate: %s", err.Error())
+	}
+
+	defer client.Close()
+
+	cerr := client.Put([]byte("key"), []byte("value"))
+
+	if cerr != nil {
+		t.Fatalf("put: %s", cerr.Error())
+	}
+}
+
+func TestTLSReplication(t *testing.T) {
+	cert, pool := selfSigned(t)
+
+	serverConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs: pool,
+	}
+
+	peerTLS := &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{cert}}
+
+	replica, replicaAddr := serveTLS(t, serverConfig, &EngineConfig{})
+	defer replica.Close()
+
+	master, masterAddr := serveTLS(t, serverConfig, &EngineConfig{PeerTLS: peerTLS})
+	defer master.Close()
+
+	err := master.AddReplica(replicaAddr, REPLMODE_SYNC)
+
+	if err != nil {
+		t.Fatalf("add replica: %s", err.Error())
+	}
+
+	client, err := NewClientWithConfig(masterAddr, &ClientConfig{TLS: peerTLS})
+
+	if err != nil {
+		t.Fatalf("connect: %s", err.Error())
+	}
+
+	defer client.Close()
+
+	replicaClient, err := NewClientWithConfig(replicaAddr, &ClientConfig{TLS: peerTLS})
+
+	if err != nil {
+		t.Fatalf("connect to replica: %s", err.Error())
+	}
+
+	defer replicaClient.Close()
+
+	// Writes are queued for the replica until its snapshot is through.
+	for i := 0; i < 100; i++ {
+		cerr := client.Put([]byte("key"), []byte("value"))
+
+		if cerr != nil {
+			t.Fatalf("put: %s", cerr.Error())
+		}
+
+		value, _ := replicaClient.Get([]byte("key"))
+
+		if bytes.Equal(value, []byte("value")) {
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("write never reached the replica")
+}